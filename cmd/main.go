@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/barasher/prometheus-to-opentsdb/internal"
@@ -14,9 +17,10 @@ import (
 )
 
 const (
-	retOk          int = 0
-	retConfFailure int = 1
-	retExecFailure int = 2
+	retOk             int = 0
+	retConfFailure    int = 1
+	retExecFailure    int = 2
+	retPartialFailure int = 3
 )
 
 const (
@@ -25,6 +29,19 @@ const (
 	fromParamKey         string = "f"
 	toParamKey           string = "t"
 	simuParamKey         string = "s"
+	incrementalParamKey  string = "incremental"
+	deadLetterParamKey   string = "d"
+	alignParamKey        string = "align"
+	chunkParamKey        string = "chunk"
+	progressParamKey     string = "p"
+)
+
+const defaultChunk string = "24h"
+
+const (
+	daemonCmd   string = "daemon"
+	replayCmd   string = "replay"
+	backfillCmd string = "backfill"
 )
 
 const defaultLoggingLevel string = "info"
@@ -56,88 +73,583 @@ func main() {
 }
 
 func doMain(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case daemonCmd:
+			return doDaemon(args[1:])
+		case replayCmd:
+			return doReplay(args[1:])
+		case backfillCmd:
+			return doBackfill(args[1:])
+		}
+	}
+	return doExport(args)
+}
+
+func parseArgs(cmd *flag.FlagSet, args []string) int {
+	logrus.SetLevel(logrus.DebugLevel) // TODO rendre configurable
+
+	if err := cmd.Parse(args); err != nil {
+		if err != flag.ErrHelp {
+			logrus.Errorf("error while parsing command line arguments: %v", err)
+		}
+		return retConfFailure
+	}
+	return retOk
+}
+
+func loadConfs(exporterConfParam string, queryConfParam string) (internal.ExporterConf, []internal.QueryConf, int) {
+	if exporterConfParam == "" {
+		logrus.Errorf("no exporter configuration file provided provided (-%v)", exporterConfParamKey)
+		return internal.ExporterConf{}, nil, retConfFailure
+	}
+	expConf, err := internal.GetExporterConf(exporterConfParam)
+	if err != nil {
+		logrus.Errorf("error while loading exporter configuration file '%v': %v", exporterConfParam, err)
+		return expConf, nil, retConfFailure
+	}
+	if err := setLoggingLevel(expConf.LoggingLevel); err != nil {
+		logrus.Errorf("%v", err)
+		return expConf, nil, retConfFailure
+	}
+
+	if queryConfParam == "" {
+		logrus.Errorf("no query description file provided (-%v)", queryConfParamKey)
+		return expConf, nil, retConfFailure
+	}
+	queryConfs, err := internal.GetQueryConfs(queryConfParam)
+	if err != nil {
+		logrus.Errorf("error while loading query description file '%v': %v", queryConfParam, err)
+		return expConf, nil, retConfFailure
+	}
+	return expConf, queryConfs, retOk
+}
+
+// runner executes queries with shared connectors
+type runner struct {
+	prometheus internal.Prometheus
+	sink       internal.Sink
+	// simulation mode : metrics are printed, checkpoints are not updated
+	simulation bool
+	// state is nil if no state file is configured
+	state *internal.StateStore
+	// incremental starts the queries from their checkpoint when available
+	incremental bool
+}
+
+func newRunner(expConf internal.ExporterConf, simu bool, incremental bool) (runner, int) {
+	r := runner{incremental: incremental, simulation: simu}
+	var err error
+	if expConf.StateFile != "" {
+		state, err := internal.NewStateStore(expConf.StateFile)
+		if err != nil {
+			logrus.Errorf("error while loading state file: %v", err)
+			return r, retConfFailure
+		}
+		r.state = &state
+	} else if incremental {
+		logrus.Errorf("incremental mode requires a state file in the exporter configuration")
+		return r, retConfFailure
+	}
+	if r.prometheus, err = internal.NewPrometheus(expConf); err != nil {
+		logrus.Errorf("error while creating prometheus connector: %v", err)
+		return r, retExecFailure
+	}
+	if simu {
+		r.sink = internal.NewJSONSink(os.Stdout)
+		return r, retOk
+	}
+	if r.sink, err = internal.NewSink(expConf); err != nil {
+		logrus.Errorf("error while creating sinks: %v", err)
+		return r, retExecFailure
+	}
+	return r, retOk
+}
+
+func (r runner) close() {
+	if err := r.sink.Close(); err != nil {
+		logrus.Errorf("%v", err)
+	}
+}
+
+// exportMetrics pushes the exporter metrics to the Pushgateway and writes them to the textfile, if configured
+func exportMetrics(c internal.ExporterConf) {
+	if c.MetricsPushgatewayURL != "" {
+		if err := internal.PushMetrics(c.MetricsPushgatewayURL); err != nil {
+			logrus.Errorf("%v", err)
+		}
+	}
+	if c.MetricsTextfile != "" {
+		if err := internal.WriteMetrics(c.MetricsTextfile); err != nil {
+			logrus.Errorf("%v", err)
+		}
+	}
+}
+
+// serveMetrics serves the exporter metrics on /metrics
+func serveMetrics(address string) (*http.Server, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error while listening on %v for metrics: %v", address, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", internal.MetricsHandler())
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			logrus.Errorf("error while serving metrics: %v", err)
+		}
+	}()
+	logrus.Infof("Metrics served on http://%v/metrics", l.Addr())
+	return srv, nil
+}
+
+func doExport(args []string) int {
 	cmd := flag.NewFlagSet("Exporter", flag.ContinueOnError)
-	queryConfParam := cmd.String(queryConfParamKey, "", "Query description file")
+	queryConfParam := cmd.String(queryConfParamKey, "", "Query description file, job file or directory")
 	exporterConfParam := cmd.String(exporterConfParamKey, "", "Exporter configuration file")
 	fromParam := cmd.String(fromParamKey, "", "From / start date")
 	toParam := cmd.String(toParamKey, "", "To / end date")
 	simuParam := cmd.Bool(simuParamKey, false, "Simulation mode (don't push to Opentsdb)")
+	incrementalParam := cmd.Bool(incrementalParamKey, false, "Incremental mode (start from the last checkpoint, from / start date is used for queries without checkpoint)")
+	alignParam := cmd.Bool(alignParamKey, false, "Align the start and end dates on the step of each query")
 
 	ctx := context.Background()
 
-	logrus.SetLevel(logrus.DebugLevel) // TODO rendre configurable
+	if ret := parseArgs(cmd, args); ret != retOk {
+		return ret
+	}
+	expConf, queryConfs, ret := loadConfs(*exporterConfParam, *queryConfParam)
+	if ret != retOk {
+		return ret
+	}
 
-	err := cmd.Parse(args)
+	now := time.Now()
+	var from time.Time
+	var err error
+	if !*incrementalParam || *fromParam != "" {
+		if from, err = internal.ParseTime(*fromParam, now); err != nil {
+			logrus.Errorf("error while parsing start date (%v): %v", *fromParam, err)
+			return retConfFailure
+		}
+	}
+	to, err := internal.ParseTime(*toParam, now)
 	if err != nil {
-		if err != flag.ErrHelp {
-			logrus.Errorf("error while parsing command line arguments: %v", err)
+		logrus.Errorf("error while parsing end date (%v): %v", *toParam, err)
+		return retConfFailure
+	}
+
+	r, ret := newRunner(expConf, *simuParam, *incrementalParam)
+	if ret != retOk {
+		return ret
+	}
+	defer exportMetrics(expConf)
+	defer r.close()
+
+	failures := 0
+	warned := 0
+	for _, queryConf := range queryConfs {
+		queryConf.Start = from
+		queryConf.End = to
+		if *alignParam {
+			if err := alignQuery(&queryConf); err != nil {
+				logrus.Errorf("query '%v' failed: %v", queryConf.Name, err)
+				failures++
+				continue
+			}
 		}
+		report, err := r.execute(ctx, queryConf)
+		if err != nil {
+			logrus.Errorf("query '%v' failed: %v", queryConf.Name, err)
+			failures++
+			continue
+		}
+		if len(report.warnings) > 0 {
+			logrus.Warnf("query '%v' succeeded with %v Prometheus warnings (partial data)", queryConf.Name, len(report.warnings))
+			warned++
+			continue
+		}
+		logrus.Infof("query '%v' succeeded", queryConf.Name)
+	}
+	logrus.Infof("%v/%v queries succeeded (%v with warnings)", len(queryConfs)-failures, len(queryConfs), warned)
+
+	switch {
+	case failures == 0:
+		return retOk
+	case failures == len(queryConfs):
+		return retExecFailure
+	default:
+		return retPartialFailure
+	}
+}
+
+// alignQuery aligns the start and end dates of a query on its step
+func alignQuery(c *internal.QueryConf) error {
+	if c.Step == "" {
+		return nil
+	}
+	var err error
+	if !c.Start.IsZero() {
+		if c.Start, err = internal.AlignTime(c.Start, c.Step); err != nil {
+			return err
+		}
+	}
+	c.End, err = internal.AlignTime(c.End, c.Step)
+	return err
+}
+
+func doDaemon(args []string) int {
+	cmd := flag.NewFlagSet("Exporter daemon", flag.ContinueOnError)
+	queryConfParam := cmd.String(queryConfParamKey, "", "Query description file, job file or directory")
+	exporterConfParam := cmd.String(exporterConfParamKey, "", "Exporter configuration file")
+	simuParam := cmd.Bool(simuParamKey, false, "Simulation mode (don't push to Opentsdb)")
+
+	if ret := parseArgs(cmd, args); ret != retOk {
+		return ret
+	}
+	expConf, queryConfs, ret := loadConfs(*exporterConfParam, *queryConfParam)
+	if ret != retOk {
+		return ret
+	}
+
+	r, ret := newRunner(expConf, *simuParam, expConf.StateFile != "")
+	if ret != retOk {
+		return ret
+	}
+	defer r.close()
+
+	if expConf.MetricsAddress != "" {
+		srv, err := serveMetrics(expConf.MetricsAddress)
+		if err != nil {
+			logrus.Errorf("%v", err)
+			return retExecFailure
+		}
+		defer srv.Close()
+	}
+
+	scheduler, err := internal.NewScheduler(queryConfs, r.run)
+	if err != nil {
+		logrus.Errorf("error while scheduling queries: %v", err)
 		return retConfFailure
 	}
 
-	if *exporterConfParam == "" {
-		logrus.Errorf("no exporter configuration file provided provided (-%v)", exporterConfParamKey)
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			logrus.Infof("%v received, stopping", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	logrus.Infof("Daemon started with %v queries", len(queryConfs))
+	scheduler.Run(ctx)
+	cancel()
+	return retOk
+}
+
+func doBackfill(args []string) int {
+	cmd := flag.NewFlagSet("Exporter backfill", flag.ContinueOnError)
+	queryConfParam := cmd.String(queryConfParamKey, "", "Query description file, job file or directory")
+	exporterConfParam := cmd.String(exporterConfParamKey, "", "Exporter configuration file")
+	fromParam := cmd.String(fromParamKey, "", "From / start date")
+	toParam := cmd.String(toParamKey, "", "To / end date")
+	chunkParam := cmd.String(chunkParamKey, defaultChunk, "Size of the chunks")
+	progressParam := cmd.String(progressParamKey, "", "Progress file (the backfill resumes at the last finished chunk)")
+	simuParam := cmd.Bool(simuParamKey, false, "Simulation mode (don't push to Opentsdb)")
+	alignParam := cmd.Bool(alignParamKey, false, "Align the start and end dates on the step of each query")
+
+	ctx := context.Background()
+
+	if ret := parseArgs(cmd, args); ret != retOk {
+		return ret
+	}
+	expConf, queryConfs, ret := loadConfs(*exporterConfParam, *queryConfParam)
+	if ret != retOk {
+		return ret
+	}
+
+	// relative dates are not supported : the progress is tied to the date range, it would change between executions
+	from, err := internal.ParseAbsoluteTime(*fromParam)
+	if err != nil {
+		logrus.Errorf("error while parsing start date (%v): %v", *fromParam, err)
 		return retConfFailure
 	}
-	expConf, err := internal.GetExporterConf(*exporterConfParam)
+	to, err := internal.ParseAbsoluteTime(*toParam)
 	if err != nil {
-		logrus.Errorf("error while loading exporter configuration file '%v': %v", *exporterConfParam, err)
+		logrus.Errorf("error while parsing end date (%v): %v", *toParam, err)
+		return retConfFailure
+	}
+	chunk, err := time.ParseDuration(*chunkParam)
+	if err != nil || chunk <= 0 {
+		logrus.Errorf("wrong chunk size (%v)", *chunkParam)
 		return retConfFailure
 	}
-	if setLoggingLevel(expConf.LoggingLevel) != nil {
+	if err := checkChunk(chunk, queryConfs); err != nil {
 		logrus.Errorf("%v", err)
 		return retConfFailure
 	}
-
-	if *queryConfParam == "" {
-		logrus.Errorf("no query description file provided (-%v)", queryConfParamKey)
+	if *progressParam == "" {
+		logrus.Errorf("no progress file provided (-%v)", progressParamKey)
 		return retConfFailure
 	}
-	queryConf, err := internal.GetQueryConf(*queryConfParam)
+	progress, err := internal.NewStateStore(*progressParam)
 	if err != nil {
-		logrus.Errorf("error while loading query description file '%v': %v", *queryConfParam, err)
+		logrus.Errorf("error while loading progress file: %v", err)
 		return retConfFailure
 	}
 
-	if queryConf.Start, err = time.Parse(time.RFC3339, *fromParam); err != nil {
-		logrus.Errorf("error while parsing start date (%v): %v", *fromParam, err)
-		return retConfFailure
+	r, ret := newRunner(expConf, *simuParam, false)
+	if ret != retOk {
+		return ret
 	}
-	if queryConf.End, err = time.Parse(time.RFC3339, *toParam); err != nil {
-		logrus.Errorf("error while parsing end date (%v): %v", *toParam, err)
-		return retConfFailure
+	defer exportMetrics(expConf)
+	defer r.close()
+	r.state = nil // the checkpoints of the exporter state file are not updated
+
+	failures := 0
+	for _, queryConf := range queryConfs {
+		queryConf.Start = from
+		queryConf.End = to
+		if *alignParam {
+			if err := alignQuery(&queryConf); err != nil {
+				logrus.Errorf("query '%v' failed: %v", queryConf.Name, err)
+				failures++
+				continue
+			}
+		}
+		if err := r.backfill(ctx, queryConf, chunk, progress); err != nil {
+			logrus.Errorf("query '%v' failed: %v", queryConf.Name, err)
+			failures++
+			continue
+		}
+		logrus.Infof("query '%v' succeeded", queryConf.Name)
 	}
+	logrus.Infof("%v/%v queries succeeded", len(queryConfs)-failures, len(queryConfs))
 
-	prometheus, err := internal.NewPrometheus(expConf)
-	if err != nil {
-		logrus.Errorf("error while creating prometheus connector: %v", err)
+	switch {
+	case failures == 0:
+		return retOk
+	case failures == len(queryConfs):
 		return retExecFailure
+	default:
+		return retPartialFailure
 	}
-	neutral, err := prometheus.Query(ctx, queryConf)
-	if err != nil {
-		logrus.Errorf("%v", err)
-		return retExecFailure
+}
+
+// backfill executes a query chunk by chunk, starting after the last finished chunk of the same date range,
+// the progress is saved after each chunk
+func (r runner) backfill(ctx context.Context, queryConf internal.QueryConf, chunk time.Duration, progress internal.StateStore) error {
+	key := backfillKey(queryConf)
+	start := queryConf.Start
+	if checkpoint, found := progress.Checkpoint(key); found && checkpoint.After(start) && !checkpoint.After(queryConf.End) {
+		logrus.Infof("query '%v' resumes at %v", queryConf.Name, checkpoint)
+		start = checkpoint
+	}
+	if !start.Before(queryConf.End) {
+		logrus.Infof("query '%v' is already backfilled", queryConf.Name)
+		return nil
 	}
 
-	if *simuParam { // simulation mode
-		j, err := json.MarshalIndent(neutral, "", "\t")
+	total := queryConf.End.Sub(start)
+	began := time.Now()
+	for chunkStart := start; chunkStart.Before(queryConf.End); {
+		chunkEnd := chunkStart.Add(chunk)
+		if chunkEnd.After(queryConf.End) {
+			chunkEnd = queryConf.End
+		}
+		chunkConf := queryConf
+		chunkConf.Start = chunkStart
+		chunkConf.End = chunkEnd
+
+		chunkBegan := time.Now()
+		report, err := r.execute(ctx, chunkConf)
 		if err != nil {
-			logrus.Errorf("error while printing results: %v", err)
-			return retExecFailure
+			return fmt.Errorf("error on chunk %v to %v: %v", chunkStart, chunkEnd, err)
 		}
-		fmt.Printf("%v\n", string(j))
-		return retOk
+		if !r.simulation {
+			if err := progress.SetCheckpoint(key, chunkEnd); err != nil {
+				return fmt.Errorf("error while saving progress: %v", err)
+			}
+		}
+		if len(report.warnings) > 0 {
+			logrus.Warnf("query '%v', chunk %v to %v: %v Prometheus warnings (partial data)", queryConf.Name, chunkStart, chunkEnd, len(report.warnings))
+		}
+		elapsed := time.Since(chunkBegan)
+		done := chunkEnd.Sub(start)
+		eta := time.Duration(float64(time.Since(began)) * float64(total-done) / float64(done))
+		logrus.Infof("query '%v', chunk %v to %v: %v points in %v (%.0f points/s), %.1f%% done, ETA %v",
+			queryConf.Name, chunkStart, chunkEnd, report.points, elapsed.Round(time.Millisecond),
+			float64(report.points)/elapsed.Seconds(), 100*float64(done)/float64(total), eta.Round(time.Second))
+		chunkStart = chunkEnd
+	}
+	return nil
+}
+
+// checkChunk checks that the chunk size is a multiple of the step of each query,
+// otherwise the datapoints of a chunk would not be on the same grid as the ones of the previous chunk
+func checkChunk(chunk time.Duration, queryConfs []internal.QueryConf) error {
+	for _, curConf := range queryConfs {
+		if curConf.Step == "" {
+			continue
+		}
+		step, err := time.ParseDuration(curConf.Step)
+		if err != nil {
+			return fmt.Errorf("query '%v': error while parsing step (%v): %v", curConf.Name, curConf.Step, err)
+		}
+		if step <= 0 || chunk%step != 0 {
+			return fmt.Errorf("query '%v': chunk size (%v) is not a multiple of the step (%v)", curConf.Name, chunk, curConf.Step)
+		}
+	}
+	return nil
+}
+
+// backfillKey identifies the progress of a query in the progress file : the progress of a backfill
+// is only resumed by a backfill of the same date range
+func backfillKey(c internal.QueryConf) string {
+	return fmt.Sprintf("%v [%v, %v)", c.Name, c.Start.UTC().Format(time.RFC3339), c.End.UTC().Format(time.RFC3339))
+}
+
+func doReplay(args []string) int {
+	cmd := flag.NewFlagSet("Exporter replay", flag.ContinueOnError)
+	exporterConfParam := cmd.String(exporterConfParamKey, "", "Exporter configuration file")
+	deadLetterParam := cmd.String(deadLetterParamKey, "", "Dead letter file to replay")
+
+	ctx := context.Background()
+
+	if ret := parseArgs(cmd, args); ret != retOk {
+		return ret
+	}
+	if *exporterConfParam == "" {
+		logrus.Errorf("no exporter configuration file provided provided (-%v)", exporterConfParamKey)
+		return retConfFailure
+	}
+	expConf, err := internal.GetExporterConf(*exporterConfParam)
+	if err != nil {
+		logrus.Errorf("error while loading exporter configuration file '%v': %v", *exporterConfParam, err)
+		return retConfFailure
+	}
+	if err := setLoggingLevel(expConf.LoggingLevel); err != nil {
+		logrus.Errorf("%v", err)
+		return retConfFailure
+	}
+	if *deadLetterParam == "" {
+		logrus.Errorf("no dead letter file provided (-%v)", deadLetterParamKey)
+		return retConfFailure
 	}
 
-	opentsdb, err := internal.NewOpentsdb(expConf)
+	deadLetter := internal.NewDeadLetter(*deadLetterParam)
+	points, err := deadLetter.Read()
 	if err != nil {
-		logrus.Errorf("error while creating opentsdb connector: %v", err)
-		return retExecFailure
+		logrus.Errorf("%v", err)
+		return retConfFailure
+	}
+	metrics := make([]internal.OpentsdbMetric, len(points))
+	for i, curPoint := range points {
+		metrics[i] = curPoint.Datapoint
 	}
-	if err := opentsdb.Push(ctx, neutral); err != nil {
+
+	expConf.DeadLetterFile = "" // the replayed file is rewritten with the remaining datapoints
+	sinks, err := internal.NewOpentsdbSinks(expConf)
+	if err != nil {
+		logrus.Errorf("error while creating opentsdb connectors: %v", err)
+		return retConfFailure
+	}
+	defer exportMetrics(expConf)
+	remaining := []internal.RejectedPoint{}
+	rejected := make(map[string]bool)
+	for _, curSink := range sinks {
+		pushErr := curSink.Push(ctx, metrics)
+		curSink.Close()
+		pErr, ok := pushErr.(*internal.PushError)
+		if !ok && pushErr != nil {
+			logrus.Errorf("%v", pushErr)
+			return retExecFailure
+		}
+		if !ok {
+			continue
+		}
+		for _, curPoint := range pErr.Points() { // a datapoint is kept if a sink rejected it
+			m := curPoint.Datapoint
+			key := fmt.Sprintf("%v %v %v %v", m.Metric, m.Timestamp, m.Value, m.Tags)
+			if !rejected[key] {
+				rejected[key] = true
+				remaining = append(remaining, curPoint)
+			}
+		}
+	}
+	if err := deadLetter.Rewrite(remaining); err != nil {
 		logrus.Errorf("%v", err)
 		return retExecFailure
 	}
+	logrus.Infof("%v/%v datapoints replayed", len(points)-len(remaining), len(points))
 
+	if len(remaining) > 0 {
+		return retExecFailure
+	}
 	return retOk
 }
+
+// run executes a query on Prometheus and pushes the results to the sinks,
+// the checkpoint of the query is updated once the push succeeded
+func (r runner) run(ctx context.Context, queryConf internal.QueryConf) error {
+	_, err := r.execute(ctx, queryConf)
+	return err
+}
+
+// queryReport describes an execution of a query
+type queryReport struct {
+	// Prometheus warnings of the query
+	warnings []string
+	// count of pushed points
+	points int
+	// resolved timestamp precision of the query
+	precision string
+}
+
+// execute runs a query like run and reports the execution
+func (r runner) execute(ctx context.Context, queryConf internal.QueryConf) (queryReport, error) {
+	report := queryReport{precision: r.prometheus.TimestampPrecision(queryConf)}
+	if r.incremental {
+		if checkpoint, found := r.state.Checkpoint(queryConf.Name); found {
+			logrus.Infof("query '%v' starts from its checkpoint: %v", queryConf.Name, checkpoint)
+			queryConf.Start = checkpoint
+		}
+		if queryConf.Start.IsZero() {
+			return report, fmt.Errorf("no checkpoint and no start date provided")
+		}
+		if !queryConf.Start.Before(queryConf.End) {
+			logrus.Infof("query '%v' is up to date", queryConf.Name)
+			return report, nil
+		}
+	}
+
+	// the metrics are streamed to the sinks as they are converted
+	bulks := make(chan []internal.OpentsdbMetric)
+	var queryErr error
+	go func() {
+		defer close(bulks)
+		report.points, report.warnings, queryErr = r.prometheus.QueryStream(ctx, queryConf, bulks)
+	}()
+	pushErr := r.sink.PushStream(ctx, bulks) // returns once bulks is closed
+	if queryErr != nil {
+		return report, queryErr
+	}
+	if pushErr != nil {
+		return report, pushErr
+	}
+	if r.simulation {
+		logrus.Infof("query '%v' simulated from %v to %v: %v points printed, timestamp precision: %v",
+			queryConf.Name, queryConf.Start, queryConf.End, report.points, report.precision)
+	}
+	if r.state != nil && !r.simulation {
+		if err := r.state.SetCheckpoint(queryConf.Name, queryConf.End); err != nil {
+			return report, fmt.Errorf("error while saving checkpoint: %v", err)
+		}
+	}
+	return report, nil
+}
@@ -1,9 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/barasher/prometheus-to-opentsdb/internal"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -73,3 +89,445 @@ func TestSetLoggingLevel(t *testing.T) {
 	}
 	logrus.SetLevel(l)
 }
+
+func startBackends(t *testing.T) (*httptest.Server, *httptest.Server) {
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.FormValue("query") == "failing" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"status":"error","errorType":"bad_data","error":"failing query"}`)
+			return
+		}
+		io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"k":"v"},"values":[[1564592490,"2"],[1564592520,"3"]]}]}}`)
+	}))
+	tsdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"failed":0,"success":2}`)
+	}))
+	return prom, tsdb
+}
+
+func writeConfFiles(t *testing.T, dir string, promURL string, tsdbURL string, queries ...string) (string, string) {
+	expFile := filepath.Join(dir, "exporter.json")
+	exp := fmt.Sprintf(`{"PrometheusURL":"%v","OpentsdbURL":"%v"}`, promURL, tsdbURL)
+	assert.Nil(t, ioutil.WriteFile(expFile, []byte(exp), 0644))
+
+	job := `{"Queries":[`
+	for i, q := range queries {
+		if i > 0 {
+			job += ","
+		}
+		job += fmt.Sprintf(`{"Name":"q%v","MetricName":"m","Query":"%v","Step":"30s"}`, i, q)
+	}
+	job += "]}"
+	jobFile := filepath.Join(dir, "job.json")
+	assert.Nil(t, ioutil.WriteFile(jobFile, []byte(job), 0644))
+	return expFile, jobFile
+}
+
+func TestDoMainSimulationPrecision(t *testing.T) {
+	prom, tsdb := startBackends(t)
+	defer prom.Close()
+	defer tsdb.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, jobFile := writeConfFiles(t, dir, prom.URL, tsdb.URL, "q")
+	expFile := filepath.Join(dir, "exporterMs.json")
+	exp := fmt.Sprintf(`{"PrometheusURL":"%v","OpentsdbURL":"%v","TimestampPrecision":"ms"}`, prom.URL, tsdb.URL)
+	assert.Nil(t, ioutil.WriteFile(expFile, []byte(exp), 0644))
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	assert.Equal(t, retOk, doMain([]string{"-q", jobFile, "-e", expFile, "-f", "2019-07-31T17:00:00Z", "-t", "2019-07-31T17:05:00Z", "-s"}))
+	reported := false
+	for _, curEntry := range hook.AllEntries() {
+		if strings.Contains(curEntry.Message, "query 'q0' simulated") {
+			reported = true
+			assert.Contains(t, curEntry.Message, "2 points printed, timestamp precision: ms")
+		}
+	}
+	assert.True(t, reported)
+}
+
+func TestDoMainJob(t *testing.T) {
+	var tcs = []struct {
+		tcID      string
+		inQueries []string
+		expRet    int
+	}{
+		{"allOk", []string{"q1", "q2"}, retOk},
+		{"partialFailure", []string{"q1", "failing"}, retPartialFailure},
+		{"allFailed", []string{"failing", "failing"}, retExecFailure},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			prom, tsdb := startBackends(t)
+			defer prom.Close()
+			defer tsdb.Close()
+			dir, err := ioutil.TempDir("", "p2o")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			expFile, jobFile := writeConfFiles(t, dir, prom.URL, tsdb.URL, tc.inQueries...)
+
+			ret := doMain([]string{
+				"-q", jobFile,
+				"-e", expFile,
+				"-f", "2019-07-31T17:00:00.000Z",
+				"-t", "2019-07-31T17:03:00.000Z",
+			})
+			assert.Equal(t, tc.expRet, ret)
+		})
+	}
+}
+
+func TestDoDaemonConfigurationFailure(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inParams []string
+	}{
+		{"noQueryConfParam", []string{"daemon", "-e", "../testdata/confFiles/exporterConf_nominal.json"}},
+		{"noSchedule", []string{
+			"daemon",
+			"-q", "../testdata/confFiles/queryConf_nominal.json",
+			"-e", "../testdata/confFiles/exporterConf_nominal.json",
+		}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, retConfFailure, doMain(tc.inParams))
+		})
+	}
+}
+
+func TestDoDaemonSigterm(t *testing.T) {
+	var queryCount int32
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queryCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+	}))
+	defer prom.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	expFile, _ := writeConfFiles(t, dir, prom.URL, "http://127.0.0.1:1")
+	jobFile := filepath.Join(dir, "daemon.json")
+	job := `{"MetricName":"m","Query":"q","Step":"1s","Schedule":"50ms","Window":"1s"}`
+	assert.Nil(t, ioutil.WriteFile(jobFile, []byte(job), 0644))
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	assert.Equal(t, retOk, doMain([]string{"daemon", "-e", expFile, "-q", jobFile, "-s"}))
+	assert.True(t, atomic.LoadInt32(&queryCount) > 0)
+}
+
+func TestDoMainIncremental(t *testing.T) {
+	starts := []string{}
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		starts = append(starts, r.FormValue("start"))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"k":"v"},"values":[[1564592490,"2"]]}]}}`)
+	}))
+	defer prom.Close()
+	_, tsdb := startBackends(t)
+	defer tsdb.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, jobFile := writeConfFiles(t, dir, prom.URL, tsdb.URL, "q")
+	expFile := filepath.Join(dir, "exporterState.json")
+	exp := fmt.Sprintf(`{"PrometheusURL":"%v","OpentsdbURL":"%v","StateFile":"%v"}`, prom.URL, tsdb.URL, filepath.Join(dir, "state.json"))
+	assert.Nil(t, ioutil.WriteFile(expFile, []byte(exp), 0644))
+
+	// no checkpoint, no start date
+	assert.Equal(t, retExecFailure, doMain([]string{"-q", jobFile, "-e", expFile, "-incremental", "-t", "2019-07-31T17:03:00Z"}))
+	// no checkpoint, start date
+	assert.Equal(t, retOk, doMain([]string{"-q", jobFile, "-e", expFile, "-incremental", "-f", "2019-07-31T17:00:00Z", "-t", "2019-07-31T17:03:00Z"}))
+	// checkpoint
+	assert.Equal(t, retOk, doMain([]string{"-q", jobFile, "-e", expFile, "-incremental", "-f", "2019-07-31T17:00:00Z", "-t", "2019-07-31T17:06:00Z"}))
+	// up to date
+	assert.Equal(t, retOk, doMain([]string{"-q", jobFile, "-e", expFile, "-incremental", "-t", "2019-07-31T17:06:00Z"}))
+
+	assert.Len(t, starts, 2)
+	assert.Equal(t, "1564592580", starts[1]) // 2019-07-31T17:03:00Z
+}
+
+func TestDoMainAlign(t *testing.T) {
+	ranges := [][]string{}
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, []string{r.FormValue("start"), r.FormValue("end")})
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"k":"v"},"values":[[1564592490,"2"]]}]}}`)
+	}))
+	defer prom.Close()
+	_, tsdb := startBackends(t)
+	defer tsdb.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	expFile, jobFile := writeConfFiles(t, dir, prom.URL, tsdb.URL, "q")
+
+	assert.Equal(t, retOk, doMain([]string{"-q", jobFile, "-e", expFile, "-f", "1564592410", "-t", "1564592595", "-align"}))
+	assert.Equal(t, [][]string{{"1564592400", "1564592580"}}, ranges) // step : 30s
+	assert.Equal(t, retOk, doMain([]string{"-q", jobFile, "-e", expFile, "-f", "now-1h", "-t", "now"}))
+	assert.Len(t, ranges, 2)
+}
+
+func TestDoBackfill(t *testing.T) {
+	ranges := [][]string{}
+	failAt := ""
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.FormValue("start") == failAt {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"status":"error","errorType":"bad_data","error":"failing query"}`)
+			return
+		}
+		ranges = append(ranges, []string{r.FormValue("start"), r.FormValue("end")})
+		io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"k":"v"},"values":[[1564592490,"2"]]}]}}`)
+	}))
+	defer prom.Close()
+	_, tsdb := startBackends(t)
+	defer tsdb.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	expFile, jobFile := writeConfFiles(t, dir, prom.URL, tsdb.URL, "q")
+	progressFile := filepath.Join(dir, "progress.json")
+	args := []string{"backfill", "-q", jobFile, "-e", expFile, "-f", "2019-07-31T00:00:00Z", "-t", "2019-07-31T03:00:00Z", "-chunk", "1h", "-p", progressFile}
+
+	// interrupted at the third chunk
+	failAt = "1564538400" // 2019-07-31T02:00:00Z
+	assert.Equal(t, retExecFailure, doMain(args))
+	assert.Equal(t, [][]string{{"1564531200", "1564534800"}, {"1564534800", "1564538400"}}, ranges)
+	// resumed at the last finished chunk
+	failAt = ""
+	ranges = ranges[:0]
+	assert.Equal(t, retOk, doMain(args))
+	assert.Equal(t, [][]string{{"1564538400", "1564542000"}}, ranges)
+	// already backfilled
+	ranges = ranges[:0]
+	assert.Equal(t, retOk, doMain(args))
+	assert.Len(t, ranges, 0)
+	// the progress of another date range is ignored
+	ranges = ranges[:0]
+	assert.Equal(t, retOk, doMain([]string{"backfill", "-q", jobFile, "-e", expFile, "-f", "2019-07-30T00:00:00Z", "-t", "2019-07-30T02:00:00Z", "-chunk", "1h", "-p", progressFile}))
+	assert.Equal(t, [][]string{{"1564444800", "1564448400"}, {"1564448400", "1564452000"}}, ranges)
+}
+
+func TestCheckChunk(t *testing.T) {
+	var tcs = []struct {
+		tcID    string
+		inChunk time.Duration
+		inStep  string
+		expOk   bool
+	}{
+		{"multiple", time.Hour, "30s", true},
+		{"equal", time.Hour, "1h", true},
+		{"noStep", time.Hour, "", true},
+		{"notMultiple", time.Hour, "7m", false},
+		{"shorterThanStep", time.Hour, "2h", false},
+		{"unparsableStep", time.Hour, "blabla", false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			err := checkChunk(tc.inChunk, []internal.QueryConf{{Name: "q0", Step: "1m"}, {Name: "q1", Step: tc.inStep}})
+			assert.Equal(t, tc.expOk, err == nil)
+		})
+	}
+}
+
+func TestDoBackfillConfigurationFailure(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inParams []string
+	}{
+		{"noProgressFile", []string{"-f", "2019-07-31T00:00:00Z", "-t", "2019-07-31T03:00:00Z"}},
+		{"wrongChunk", []string{"-f", "2019-07-31T00:00:00Z", "-t", "2019-07-31T03:00:00Z", "-p", "progress.json", "-chunk", "blabla"}},
+		{"wrongStart", []string{"-f", "blabla", "-t", "2019-07-31T03:00:00Z", "-p", "progress.json"}},
+		{"relativeStart", []string{"-f", "now-30d", "-t", "2019-07-31T03:00:00Z", "-p", "progress.json"}},
+		{"relativeEnd", []string{"-f", "2019-07-31T00:00:00Z", "-t", "now", "-p", "progress.json"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			args := append([]string{"backfill", "-q", "../testdata/confFiles/queryConf_nominal.json", "-e", "../testdata/confFiles/exporterConf_nominal.json"}, tc.inParams...)
+			assert.Equal(t, retConfFailure, doMain(args))
+		})
+	}
+}
+
+func TestDoMainIncrementalWithoutStateFile(t *testing.T) {
+	assert.Equal(t, retConfFailure, doMain([]string{
+		"-q", "../testdata/confFiles/queryConf_nominal.json",
+		"-e", "../testdata/confFiles/exporterConf_nominal.json",
+		"-incremental",
+		"-t", "2019-07-31T17:03:00.000Z",
+	}))
+}
+
+func TestDoReplay(t *testing.T) {
+	tsdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed := []internal.OpentsdbMetric{}
+		json.NewDecoder(r.Body).Decode(&pushed)
+		if pushed[0].Metric == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"failed":1,"success":0,"errors":[{"datapoint":{"metric":"bad","timestamp":42,"value":1},"error":"still bad"}]}`)
+			return
+		}
+		io.WriteString(w, `{"failed":0,"success":1}`)
+	}))
+	defer tsdb.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	expFile := filepath.Join(dir, "exporter.json")
+	exp := fmt.Sprintf(`{"PrometheusURL":"http://127.0.0.1:1","OpentsdbURL":"%v","BulkSize":1}`, tsdb.URL)
+	assert.Nil(t, ioutil.WriteFile(expFile, []byte(exp), 0644))
+	deadLetterFile := filepath.Join(dir, "deadLetter.jsonl")
+	content := `{"datapoint":{"metric":"good","timestamp":42,"value":1},"error":"unknown metric"}
+{"datapoint":{"metric":"bad","timestamp":42,"value":1},"error":"unknown metric"}
+`
+	assert.Nil(t, ioutil.WriteFile(deadLetterFile, []byte(content), 0644))
+
+	assert.Equal(t, retExecFailure, doMain([]string{"replay", "-e", expFile, "-d", deadLetterFile}))
+	remaining, err := internal.NewDeadLetter(deadLetterFile).Read()
+	assert.Nil(t, err)
+	assert.Len(t, remaining, 1)
+	assert.Equal(t, "bad", remaining[0].Datapoint.Metric)
+	assert.Equal(t, "still bad", remaining[0].Error)
+}
+
+func TestDoReplaySinks(t *testing.T) {
+	var received int32
+	tsdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		io.WriteString(w, `{"failed":0,"success":1}`)
+	}))
+	defer tsdb.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	expFile := filepath.Join(dir, "exporter.json")
+	exp := fmt.Sprintf(`{"PrometheusURL":"http://127.0.0.1:1","Sinks":[{"Type":"opentsdb","URL":"%v"},{"Type":"json","File":"%v"}]}`, tsdb.URL, filepath.Join(dir, "out.json"))
+	assert.Nil(t, ioutil.WriteFile(expFile, []byte(exp), 0644))
+	deadLetterFile := filepath.Join(dir, "deadLetter.jsonl")
+	content := `{"datapoint":{"metric":"good","timestamp":42,"value":1},"error":"unknown metric"}
+`
+	assert.Nil(t, ioutil.WriteFile(deadLetterFile, []byte(content), 0644))
+
+	assert.Equal(t, retOk, doMain([]string{"replay", "-e", expFile, "-d", deadLetterFile}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+
+	// telnet sink only
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	assert.Nil(t, ioutil.WriteFile(deadLetterFile, []byte(content), 0644))
+	exp = fmt.Sprintf(`{"PrometheusURL":"http://127.0.0.1:1","Sinks":[{"Type":"opentsdb-telnet","Address":"%v"}]}`, l.Addr())
+	assert.Nil(t, ioutil.WriteFile(expFile, []byte(exp), 0644))
+	assert.Equal(t, retOk, doMain([]string{"replay", "-e", expFile, "-d", deadLetterFile}))
+	select {
+	case l := <-lines:
+		assert.Equal(t, "put good 42 1", l)
+	case <-time.After(time.Second):
+		assert.Fail(t, "no line received")
+	}
+
+	// no opentsdb sink
+	assert.Nil(t, ioutil.WriteFile(deadLetterFile, []byte(content), 0644))
+	exp = fmt.Sprintf(`{"PrometheusURL":"http://127.0.0.1:1","Sinks":[{"Type":"json","File":"%v"}]}`, filepath.Join(dir, "out.json"))
+	assert.Nil(t, ioutil.WriteFile(expFile, []byte(exp), 0644))
+	assert.Equal(t, retConfFailure, doMain([]string{"replay", "-e", expFile, "-d", deadLetterFile}))
+}
+
+func TestDoReplayConfigurationFailure(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inParams []string
+	}{
+		{"noExporterConf", []string{"replay", "-d", "deadLetter.jsonl"}},
+		{"noDeadLetter", []string{"replay", "-e", "../testdata/confFiles/exporterConf_nominal.json"}},
+		{"nonExistingDeadLetter", []string{"replay", "-e", "../testdata/confFiles/exporterConf_nominal.json", "-d", "nonExisting.jsonl"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, retConfFailure, doMain(tc.inParams))
+		})
+	}
+}
+
+func TestDoMainMetrics(t *testing.T) {
+	prom, tsdb := startBackends(t)
+	defer prom.Close()
+	defer tsdb.Close()
+	var pushedPath string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushedPath = r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, jobFile := writeConfFiles(t, dir, prom.URL, tsdb.URL, "q")
+	textfile := filepath.Join(dir, "p2o.prom")
+	expFile := filepath.Join(dir, "exporterMetrics.json")
+	exp := fmt.Sprintf(`{"PrometheusURL":"%v","OpentsdbURL":"%v","MetricsPushgatewayURL":"%v","MetricsTextfile":"%v"}`, prom.URL, tsdb.URL, gateway.URL, textfile)
+	assert.Nil(t, ioutil.WriteFile(expFile, []byte(exp), 0644))
+
+	assert.Equal(t, retOk, doMain([]string{"-q", jobFile, "-e", expFile, "-f", "2019-07-31T17:00:00Z", "-t", "2019-07-31T17:03:00Z"}))
+	assert.Equal(t, "/metrics/job/prometheus_to_opentsdb", pushedPath)
+	content, err := ioutil.ReadFile(textfile)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), `prometheus_to_opentsdb_queries_total{query="q0",status="success"}`)
+	assert.Contains(t, string(content), `prometheus_to_opentsdb_points_pushed_total{sink="opentsdb"}`)
+}
+
+func TestDoDaemonMetrics(t *testing.T) {
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+	}))
+	defer prom.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	address := l.Addr().String()
+	l.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	expFile := filepath.Join(dir, "exporterMetrics.json")
+	exp := fmt.Sprintf(`{"PrometheusURL":"%v","OpentsdbURL":"http://127.0.0.1:1","MetricsAddress":"%v"}`, prom.URL, address)
+	assert.Nil(t, ioutil.WriteFile(expFile, []byte(exp), 0644))
+	jobFile := filepath.Join(dir, "daemon.json")
+	job := `{"Name":"daemonMetrics","MetricName":"m","Query":"q","Step":"1s","Schedule":"50ms","Window":"1s"}`
+	assert.Nil(t, ioutil.WriteFile(jobFile, []byte(job), 0644))
+
+	body := make(chan string, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		b := []byte{}
+		if resp, err := http.Get("http://" + address + "/metrics"); err == nil {
+			b, _ = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		body <- string(b)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	assert.Equal(t, retOk, doMain([]string{"daemon", "-e", expFile, "-q", jobFile, "-s"}))
+	assert.Contains(t, <-body, `prometheus_to_opentsdb_queries_total{query="daemonMetrics",status="success"}`)
+}
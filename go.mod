@@ -5,6 +5,7 @@ go 1.12
 require (
 	github.com/prometheus/client_golang v1.1.0
 	github.com/prometheus/common v0.6.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.3.0
 )
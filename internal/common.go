@@ -1,13 +1,159 @@
 package internal
 
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// bulkBufferPool pools the buffers used to encode bulks
+var bulkBufferPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, 0, 64*1024)
+	return &b
+}}
+
 // OpentsdbMetric describes a metric based on Opentsdb specifications
 type OpentsdbMetric struct {
 	// Metric is the metric name
 	Metric string `json:"metric"`
-	// Timestamp is the metric timestamp (UTC timestamp)
+	// Timestamp is the metric timestamp (UTC timestamp, in seconds or in milliseconds)
 	Timestamp uint64 `json:"timestamp"`
 	// Value is the value of the Metric
-	Value float32 `json:"value"`
+	Value float64 `json:"value"`
 	// Tags describes the metric tags
 	Tags map[string]string `json:"tags"`
+	// encoded is the encoding of Tags, shared by all the points of a series (nil if not encoded yet)
+	encoded *encodedTags
+}
+
+// encodedTags holds the encodings of a tag set (sorted by key), computed once per series
+type encodedTags struct {
+	// json is the JSON object of the tags : {"k1":"v1","k2":"v2"}
+	json []byte
+	// telnet is the put line suffix of the tags : " k1=v1 k2=v2"
+	telnet []byte
+}
+
+// encodeTags encodes a tag set
+func encodeTags(tags map[string]string) *encodedTags {
+	if tags == nil {
+		return &encodedTags{json: []byte("null")}
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	e := &encodedTags{}
+	e.json = append(e.json, '{')
+	for i, k := range keys {
+		if i > 0 {
+			e.json = append(e.json, ',')
+		}
+		e.json = appendJSONString(e.json, k)
+		e.json = append(e.json, ':')
+		e.json = appendJSONString(e.json, tags[k])
+		e.telnet = append(e.telnet, ' ')
+		e.telnet = append(e.telnet, k...)
+		e.telnet = append(e.telnet, '=')
+		e.telnet = append(e.telnet, tags[k]...)
+	}
+	e.json = append(e.json, '}')
+	return e
+}
+
+// tagsEncoding returns the encoding of the tags of a metric, computing it if the metric doesn't hold it
+func (m OpentsdbMetric) tagsEncoding() *encodedTags {
+	if m.encoded != nil {
+		return m.encoded
+	}
+	return encodeTags(m.Tags)
+}
+
+// appendJSONPoints appends the JSON array of metrics sent to Opentsdb to buf
+func appendJSONPoints(buf []byte, m []OpentsdbMetric, integer bool) []byte {
+	buf = append(buf, '[')
+	for i, curMetric := range m {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, `{"metric":`...)
+		buf = appendJSONString(buf, curMetric.Metric)
+		buf = append(buf, `,"timestamp":`...)
+		buf = strconv.AppendUint(buf, curMetric.Timestamp, 10)
+		buf = append(buf, `,"value":`...)
+		buf = appendValue(buf, curMetric.Value, integer)
+		buf = append(buf, `,"tags":`...)
+		buf = append(buf, curMetric.tagsEncoding().json...)
+		buf = append(buf, '}')
+	}
+	return append(buf, ']')
+}
+
+// appendJSONString appends a string as a JSON string to buf, invalid UTF-8 is replaced like encoding/json does
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		b := s[i]
+		if b >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				buf = append(buf, s[start:i]...)
+				buf = append(buf, "\ufffd"...)
+				i += size
+				start = i
+				continue
+			}
+			if r == '\u2028' || r == '\u2029' { // line and paragraph separators, escaped like encoding/json does
+				buf = append(buf, s[start:i]...)
+				buf = append(buf, '\\', 'u', '2', '0', '2', hex[r&0xF])
+				i += size
+				start = i
+				continue
+			}
+			i += size
+			continue
+		}
+		if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+			i++
+			continue
+		}
+		buf = append(buf, s[start:i]...)
+		switch b {
+		case '"', '\\':
+			buf = append(buf, '\\', b)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		default: // control characters and HTML characters, escaped like encoding/json does
+			buf = append(buf, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xF])
+		}
+		i++
+		start = i
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
+
+// appendValue appends a value encoded for Opentsdb to buf : as an integer if integer is set and the value is integral
+// (Opentsdb stores it as an integer), as a floating point number otherwise
+func appendValue(buf []byte, v float64, integer bool) []byte {
+	if integer && v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+		return strconv.AppendInt(buf, int64(v), 10)
+	}
+	start := len(buf)
+	buf = strconv.AppendFloat(buf, v, 'g', -1, 64)
+	for _, b := range buf[start:] {
+		if b == '.' || b == 'e' || b == 'I' || b == 'N' {
+			return buf
+		}
+	}
+	return append(buf, '.', '0') // integral, Opentsdb would store it as an integer
 }
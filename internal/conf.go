@@ -3,7 +3,10 @@ package internal
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"time"
 )
 
@@ -13,6 +16,24 @@ const (
 	queryConfQueryKey      = "Query"
 	queryConfStepKey       = "Step"
 
+	rangeQueryType   = "range"
+	instantQueryType = "instant"
+
+	ignoreWarningsPolicy = "ignore"
+	warnWarningsPolicy   = "warn"
+	failWarningsPolicy   = "fail"
+
+	secondsPrecision      = "s"
+	millisecondsPrecision = "ms"
+
+	dropMaxTagsStrategy     = "drop"
+	failMaxTagsStrategy     = "fail"
+	priorityMaxTagsStrategy = "priority"
+
+	dropNonFinitePolicy    = "drop"
+	replaceNonFinitePolicy = "replace"
+	failNonFinitePolicy    = "fail"
+
 	exporterConfDesc             = "exporter configuration"
 	exporterConfPrometheusUrlKey = "PrometheusUrl"
 	exporterConfOpentsdbUrlKey   = "OpentsdbUrl"
@@ -41,11 +62,15 @@ func checkNotEmptyString(value string, fieldDesc string, structDesc string) erro
 
 // QueryConf modelize a query configuration
 type QueryConf struct {
-	// Output metric name
+	// Query name (used in reports), metric name if not provided
+	Name string
+	// Query type : range (default) or instant
+	Type string
+	// Output metric name, can be a template using the series labels (prom.{{.__name__}})
 	MetricName string
 	// Query to execute in Prometheus
 	Query string
-	// Step of the query
+	// Step of the query (optional for instant queries : evaluated at end only)
 	Step string
 	// Start time
 	Start time.Time
@@ -57,6 +82,104 @@ type QueryConf struct {
 	RemoveTags []string
 	// Tags to rename
 	RenameTags map[string]string
+	// Relabeling rules (Prometheus relabel_configs), applied to the series labels before the tags mapping
+	RelabelConfigs []RelabelConfig
+	// Schedule of the query in daemon mode : an interval (1h) or a cron expression (0 * * * *)
+	Schedule string
+	// Window of the query in daemon mode : the previous full window is exported at each execution
+	Window string
+	// Headers added to the Prometheus requests of the query
+	Headers map[string]string
+	// Tenant of the query (multi-tenant query frontends), sent as a header and added as a tag
+	Tenant string
+	// Behaviour when Prometheus returns warnings (partial data) : ignore, warn (default) or fail
+	WarningsPolicy string
+	// Behaviour on NaN and infinite values : drop (default), replace (by NonFiniteReplacement) or fail
+	NonFinitePolicy string
+	// Value replacing NaN and infinite values (replace policy)
+	NonFiniteReplacement float64
+	// Precision of the timestamps : s or ms, the exporter precision if not provided
+	TimestampPrecision string
+	// Behaviour on series with more tags than the exporter MaxTags : drop (default), fail or priority
+	MaxTagsStrategy string
+	// Tags kept by the priority strategy, by decreasing priority
+	TagsPriority []string
+}
+
+// jobConf modelize a job file : either a single query configuration or a list of query configurations
+type jobConf struct {
+	QueryConf
+	Queries []QueryConf
+}
+
+func checkQueryConf(c *QueryConf) error {
+	if err := checkNotEmptyString(c.MetricName, queryConfMetricNameKey, queryConfDesc); err != nil {
+		return err
+	}
+	if err := checkNotEmptyString(c.Query, queryConfQueryKey, queryConfDesc); err != nil {
+		return err
+	}
+	if _, err := newSeriesConverter(*c); err != nil {
+		return fmt.Errorf("%v in the %v file", err, queryConfDesc)
+	}
+	switch c.Type {
+	case "", rangeQueryType:
+		if err := checkNotEmptyString(c.Step, queryConfStepKey, queryConfDesc); err != nil {
+			return err
+		}
+	case instantQueryType:
+	default:
+		return fmt.Errorf("Unsupported query type (%v) in the %v file", c.Type, queryConfDesc)
+	}
+	switch c.WarningsPolicy {
+	case "", ignoreWarningsPolicy, warnWarningsPolicy, failWarningsPolicy:
+	default:
+		return fmt.Errorf("Unsupported warnings policy (%v) in the %v file", c.WarningsPolicy, queryConfDesc)
+	}
+	switch c.NonFinitePolicy {
+	case "", dropNonFinitePolicy, replaceNonFinitePolicy, failNonFinitePolicy:
+	default:
+		return fmt.Errorf("Unsupported non-finite values policy (%v) in the %v file", c.NonFinitePolicy, queryConfDesc)
+	}
+	switch c.MaxTagsStrategy {
+	case "", dropMaxTagsStrategy, failMaxTagsStrategy:
+	case priorityMaxTagsStrategy:
+		if len(c.TagsPriority) == 0 {
+			return fmt.Errorf("No TagsPriority provided for the %v max tags strategy in the %v file", c.MaxTagsStrategy, queryConfDesc)
+		}
+	default:
+		return fmt.Errorf("Unsupported max tags strategy (%v) in the %v file", c.MaxTagsStrategy, queryConfDesc)
+	}
+	if c.TimestampPrecision != "" {
+		if err := checkTimestampPrecision(c.Step, c.TimestampPrecision); err != nil {
+			return fmt.Errorf("%v in the %v file", err, queryConfDesc)
+		}
+	}
+	if c.Name == "" {
+		c.Name = c.MetricName
+	}
+	return nil
+}
+
+// checkTimestampPrecision checks that a precision is supported and that it can represent each step of a query
+func checkTimestampPrecision(step string, precision string) error {
+	var unit time.Duration
+	switch precision {
+	case secondsPrecision:
+		unit = time.Second
+	case millisecondsPrecision:
+		unit = time.Millisecond
+	default:
+		return fmt.Errorf("Unsupported timestamp precision (%v)", precision)
+	}
+	d, err := time.ParseDuration(step)
+	if err != nil { // step checked when the query is executed
+		return nil
+	}
+	if d%unit != 0 {
+		return fmt.Errorf("Step (%v) is not a multiple of the timestamp precision (%v)", step, precision)
+	}
+	return nil
 }
 
 // GetQueryConf loads a query configuration
@@ -65,27 +188,123 @@ func GetQueryConf(f string) (QueryConf, error) {
 	if err := loadJson(f, &c); err != nil {
 		return c, err
 	}
-	if err := checkNotEmptyString(c.MetricName, queryConfMetricNameKey, queryConfDesc); err != nil {
+	if err := checkQueryConf(&c); err != nil {
 		return c, err
 	}
-	if err := checkNotEmptyString(c.Query, queryConfQueryKey, queryConfDesc); err != nil {
-		return c, err
+
+	return c, nil
+}
+
+// GetQueryConfs loads the query configurations of a job file (a single query or a list of queries)
+// or of every json file of a directory
+func GetQueryConfs(path string) ([]QueryConf, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error when opening '%v': %v", path, err)
 	}
-	if err := checkNotEmptyString(c.Step, queryConfStepKey, queryConfDesc); err != nil {
-		return c, err
+	if !fi.IsDir() {
+		confs, err := getJobConf(path)
+		if err != nil {
+			return nil, err
+		}
+		return confs, checkQueryNames(confs)
 	}
 
-	return c, nil
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("error when listing directory '%v': %v", path, err)
+	}
+	names := []string{}
+	for _, curFile := range files {
+		if !curFile.IsDir() && filepath.Ext(curFile.Name()) == ".json" {
+			names = append(names, curFile.Name())
+		}
+	}
+	sort.Strings(names)
+	confs := []QueryConf{}
+	for _, curName := range names {
+		curConfs, err := getJobConf(filepath.Join(path, curName))
+		if err != nil {
+			return nil, err
+		}
+		confs = append(confs, curConfs...)
+	}
+	if len(confs) == 0 {
+		return nil, fmt.Errorf("No %v found in directory '%v'", queryConfDesc, path)
+	}
+	return confs, checkQueryNames(confs)
+}
+
+// checkQueryNames checks that the query names are unique : they identify the checkpoints of the queries
+func checkQueryNames(confs []QueryConf) error {
+	names := make(map[string]bool, len(confs))
+	for _, curConf := range confs {
+		if names[curConf.Name] {
+			return fmt.Errorf("duplicate query name (%v), each query requires a unique Name (default value: the metric name)", curConf.Name)
+		}
+		names[curConf.Name] = true
+	}
+	return nil
+}
+
+func getJobConf(f string) ([]QueryConf, error) {
+	j := jobConf{}
+	if err := loadJson(f, &j); err != nil {
+		return nil, err
+	}
+	if len(j.Queries) == 0 {
+		j.Queries = []QueryConf{j.QueryConf}
+	}
+	for i := range j.Queries {
+		if err := checkQueryConf(&j.Queries[i]); err != nil {
+			return nil, fmt.Errorf("query %v of file '%v': %v", i, f, err)
+		}
+	}
+	return j.Queries, nil
 }
 
 // ExporterConf modelize an exporter configuration
 type ExporterConf struct {
-	PrometheusURL string
-	OpentsdbURL   string
-	BulkSize      uint
-	ThreadCount   uint
-	PushTimeout   string
-	LoggingLevel  string
+	PrometheusURL     string
+	OpentsdbURL       string
+	BulkSize          uint
+	ThreadCount       uint
+	PushTimeout       string
+	LoggingLevel      string
+	MaxPointsPerQuery uint
+	QueryThreadCount  uint
+	StateFile         string
+	// Authentication and TLS settings of the Prometheus client
+	PrometheusClient HTTPClientConf
+	// Header carrying the query tenant, X-Scope-OrgID if not provided
+	TenantHeader string
+	// Tag carrying the query tenant, tenant if not provided
+	TenantTag string
+	// Retry policy when pushing to Opentsdb
+	PushMaxAttempts      uint
+	PushInitialBackoff   string
+	PushMaxBackoff       string
+	PushRetryStatusCodes []int
+	// Compress the bulks pushed to Opentsdb with gzip
+	PushGzip bool
+	// Encode every value as a floating point number, integral values are encoded as integers otherwise
+	FloatValues bool
+	// Precision of the timestamps of the queries without precision : s (default) or ms
+	TimestampPrecision string
+	// Maximum count of tags per datapoint (Opentsdb tsd.storage.max_tags), 8 if not provided
+	MaxTags uint
+	// Authentication, TLS and headers settings of the Opentsdb client
+	OpentsdbClient HTTPClientConf
+	// File where the datapoints that could not be pushed are appended
+	DeadLetterFile string
+	// Output backends, a single Opentsdb sink (OpentsdbURL) if not provided
+	Sinks []SinkConf
+	// Listen address (host:port) of the /metrics endpoint of the exporter metrics in daemon mode, not served if not provided
+	MetricsAddress string
+	// Pushgateway where the exporter metrics are pushed at the end of the export, backfill and replay commands
+	MetricsPushgatewayURL string
+	// File where the exporter metrics are written at the end of the export, backfill and replay commands (node_exporter textfile collector)
+	MetricsTextfile string
 }
 
 // GetExporterConf loads an exporter configuration
@@ -97,8 +316,10 @@ func GetExporterConf(f string) (ExporterConf, error) {
 	if err := checkNotEmptyString(c.PrometheusURL, exporterConfPrometheusUrlKey, exporterConfDesc); err != nil {
 		return c, err
 	}
-	if err := checkNotEmptyString(c.OpentsdbURL, exporterConfOpentsdbUrlKey, exporterConfDesc); err != nil {
-		return c, err
+	if len(c.Sinks) == 0 {
+		if err := checkNotEmptyString(c.OpentsdbURL, exporterConfOpentsdbUrlKey, exporterConfDesc); err != nil {
+			return c, err
+		}
 	}
 	return c, nil
 }
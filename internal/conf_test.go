@@ -20,6 +20,19 @@ func TestGetQueryConf(t *testing.T) {
 		{"noMetricName", "../testdata/confFiles/queryConf_noMetricName.json", false, defQueryConf},
 		{"noQuery", "../testdata/confFiles/queryConf_noQuery.json", false, defQueryConf},
 		{"noStep", "../testdata/confFiles/queryConf_noStep.json", false, defQueryConf},
+		{"wrongType", "../testdata/confFiles/queryConf_wrongType.json", false, defQueryConf},
+		{"wrongWarningsPolicy", "../testdata/confFiles/queryConf_wrongWarningsPolicy.json", false, defQueryConf},
+		{"wrongNonFinitePolicy", "../testdata/confFiles/queryConf_wrongNonFinitePolicy.json", false, defQueryConf},
+		{"wrongMetricNameTemplate", "../testdata/confFiles/queryConf_wrongMetricNameTemplate.json", false, defQueryConf},
+		{"wrongRelabelConfig", "../testdata/confFiles/queryConf_wrongRelabelConfig.json", false, defQueryConf},
+		{"wrongMaxTagsStrategy", "../testdata/confFiles/queryConf_wrongMaxTagsStrategy.json", false, defQueryConf},
+		{"priorityWithoutTags", "../testdata/confFiles/queryConf_priorityWithoutTags.json", false, defQueryConf},
+		{"instantWithoutStep", "../testdata/confFiles/queryConf_instant.json", true,
+			QueryConf{
+				MetricName: "metricname",
+				Query:      "count(kube_pod_info)",
+			},
+		},
 		{"nominal", "../testdata/confFiles/queryConf_nominal.json", true,
 			QueryConf{
 				MetricName: "metricname",
@@ -49,6 +62,50 @@ func TestGetQueryConf(t *testing.T) {
 	}
 }
 
+func TestGetQueryConfs(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		path     string
+		expOk    bool
+		expNames []string
+	}{
+		{"nonExisting", "nonExisting.json", false, nil},
+		{"unparsable", "../testdata/confFiles/unparsable.json", false, nil},
+		{"singleQuery", "../testdata/confFiles/queryConf_nominal.json", true, []string{"metricname"}},
+		{"singleQueryInvalid", "../testdata/confFiles/queryConf_noStep.json", false, nil},
+		{"job", "../testdata/confFiles/jobConf_nominal.json", true, []string{"name1", "metricname2"}},
+		{"jobInvalidQuery", "../testdata/confFiles/jobConf_noQuery.json", false, nil},
+		{"jobDuplicateNames", "../testdata/confFiles/jobConf_duplicateNames.json", false, nil},
+		{"directory", "../testdata/jobDir", true, []string{"metricnameA", "metricnameB1", "metricnameB2"}},
+		{"emptyDirectory", "../testdata/emptyDir", false, nil},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			c, err := GetQueryConfs(tc.path)
+			if tc.expOk {
+				assert.Nil(t, err)
+				names := []string{}
+				for _, cur := range c {
+					names = append(names, cur.Name)
+				}
+				assert.Equal(t, tc.expNames, names)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestGetQueryConfsJobContent(t *testing.T) {
+	c, err := GetQueryConfs("../testdata/confFiles/jobConf_nominal.json")
+	assert.Nil(t, err)
+	assert.Len(t, c, 2)
+	assert.Equal(t, "metricname2", c[1].MetricName)
+	assert.Equal(t, "query2", c[1].Query)
+	assert.Equal(t, "step2", c[1].Step)
+	assert.Equal(t, map[string]string{"addTagsKey1": "addTagVal1"}, c[1].AddTags)
+}
+
 func TestGetExporterConf(t *testing.T) {
 	defExporterConf := ExporterConf{}
 	var tcs = []struct {
@@ -62,14 +119,22 @@ func TestGetExporterConf(t *testing.T) {
 		{"unparsable", "../testdata/unparsable.json", false, defExporterConf},
 		{"noPrometheusUrl", "../testdata/confFiles/exporterConf_noPrometheusUrl.json", false, defExporterConf},
 		{"noOpentsdbUrl", "../testdata/confFiles/exporterConf_noOpentsdbUrl.json", false, defExporterConf},
-		{"nominal", "../testdata/confFiles/exporterConf_nominal.json", true,
+		{"sinksWithoutOpentsdbUrl", "../testdata/confFiles/exporterConf_sinks.json", true,
 			ExporterConf{
 				PrometheusURL: "prometheusurl",
-				OpentsdbURL:   "opentsdburl",
-				LoggingLevel:  "info",
-				BulkSize:      50,
-				ThreadCount:   2,
-				PushTimeout:   "1s",
+				Sinks:         []SinkConf{{Type: "opentsdb", URL: "opentsdburl"}, {Type: "json", File: "/tmp/out.json"}},
+			},
+		},
+		{"nominal", "../testdata/confFiles/exporterConf_nominal.json", true,
+			ExporterConf{
+				PrometheusURL:     "prometheusurl",
+				OpentsdbURL:       "opentsdburl",
+				LoggingLevel:      "info",
+				BulkSize:          50,
+				ThreadCount:       2,
+				PushTimeout:       "1s",
+				MaxPointsPerQuery: 1000,
+				QueryThreadCount:  3,
 			},
 		},
 	}
@@ -84,9 +149,34 @@ func TestGetExporterConf(t *testing.T) {
 				assert.Equal(t, tc.expExporterConf.BulkSize, c.BulkSize)
 				assert.Equal(t, tc.expExporterConf.ThreadCount, c.ThreadCount)
 				assert.Equal(t, tc.expExporterConf.PushTimeout, c.PushTimeout)
+				assert.Equal(t, tc.expExporterConf.MaxPointsPerQuery, c.MaxPointsPerQuery)
+				assert.Equal(t, tc.expExporterConf.QueryThreadCount, c.QueryThreadCount)
+				assert.Equal(t, tc.expExporterConf.Sinks, c.Sinks)
 			} else {
 				assert.NotNil(t, err)
 			}
 		})
 	}
 }
+
+func TestCheckTimestampPrecision(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inStep      string
+		inPrecision string
+		expSuccess  bool
+	}{
+		{"seconds", "30s", "s", true},
+		{"subSecondStepWithSeconds", "500ms", "s", false},
+		{"subSecondStepWithMilliseconds", "500ms", "ms", true},
+		{"subMillisecondStep", "500us", "ms", false},
+		{"noStep", "", "s", true},
+		{"unsupportedPrecision", "30s", "us", false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			err := checkTimestampPrecision(tc.inStep, tc.inPrecision)
+			assert.Equal(t, tc.expSuccess, err == nil)
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// DeadLetter stores the datapoints that could not be stored in Opentsdb as json lines, with the reason of the failure
+type DeadLetter struct {
+	path  string
+	mutex *sync.Mutex
+}
+
+// NewDeadLetter instanciates a dead letter file
+func NewDeadLetter(path string) DeadLetter {
+	return DeadLetter{path: path, mutex: &sync.Mutex{}}
+}
+
+// Append appends the datapoints of a push report to the dead letter file
+func (d DeadLetter) Append(e *PushError) error {
+	data, err := encodeDeadLetter(e.Points())
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error while opening dead letter file '%v': %v", d.path, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("error while writing dead letter file '%v': %v", d.path, err)
+	}
+	return nil
+}
+
+// Read reads all the datapoints of the dead letter file
+func (d DeadLetter) Read() ([]RejectedPoint, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f, err := os.Open(d.path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening dead letter file '%v': %v", d.path, err)
+	}
+	defer f.Close()
+
+	points := []RejectedPoint{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		p := RejectedPoint{}
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			return nil, fmt.Errorf("error while parsing line %v of dead letter file '%v': %v", line, d.path, err)
+		}
+		points = append(points, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading dead letter file '%v': %v", d.path, err)
+	}
+	return points, nil
+}
+
+// Rewrite replaces the content of the dead letter file, the file is removed if there is no datapoint left
+func (d DeadLetter) Rewrite(points []RejectedPoint) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(points) == 0 {
+		if err := os.Remove(d.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error while removing dead letter file '%v': %v", d.path, err)
+		}
+		return nil
+	}
+	data, err := encodeDeadLetter(points)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(d.path, data)
+}
+
+func encodeDeadLetter(points []RejectedPoint) ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	for _, curPoint := range points {
+		if err := enc.Encode(curPoint); err != nil {
+			return nil, fmt.Errorf("error while marshaling dead letter datapoint: %v", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
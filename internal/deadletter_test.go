@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	d := NewDeadLetter(filepath.Join(dir, "deadLetter.jsonl"))
+
+	m1 := OpentsdbMetric{Metric: "m1", Timestamp: 42, Value: 1.5, Tags: map[string]string{"k": "v"}}
+	m2 := OpentsdbMetric{Metric: "m2", Timestamp: 43, Value: 2.5, Tags: map[string]string{"k": "v"}}
+	m3 := OpentsdbMetric{Metric: "m3", Timestamp: 44, Value: 3.5, Tags: map[string]string{"k": "v"}}
+	assert.Nil(t, d.Append(&PushError{Rejected: []RejectedPoint{{Datapoint: m1, Error: "e1"}}}))
+	assert.Nil(t, d.Append(&PushError{FailedBulks: []FailedBulk{{Metrics: []OpentsdbMetric{m2, m3}, Err: fmt.Errorf("e2")}}}))
+
+	points, err := d.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []RejectedPoint{{m1, "e1"}, {m2, "e2"}, {m3, "e2"}}, points)
+
+	assert.Nil(t, d.Rewrite([]RejectedPoint{{m2, "e3"}}))
+	points, err = d.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []RejectedPoint{{m2, "e3"}}, points)
+
+	assert.Nil(t, d.Rewrite([]RejectedPoint{}))
+	_, err = os.Stat(filepath.Join(dir, "deadLetter.jsonl"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDeadLetterReadErrors(t *testing.T) {
+	_, err := NewDeadLetter("nonExisting.jsonl").Read()
+	assert.NotNil(t, err)
+	_, err = NewDeadLetter("../testdata/confFiles/unparsable.json").Read()
+	assert.NotNil(t, err)
+}
+
+func TestPushDeadLetter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"failed":1,"success":0}`)
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadLetter.jsonl")
+
+	o, err := NewOpentsdb(ExporterConf{OpentsdbURL: ts.URL, DeadLetterFile: path})
+	assert.Nil(t, err)
+	m := []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1.5}, {Metric: "m2", Timestamp: 43, Value: 2.5}}
+	assert.NotNil(t, o.Push(context.TODO(), m))
+
+	points, err := NewDeadLetter(path).Read()
+	assert.Nil(t, err)
+	assert.Len(t, points, 2)
+	assert.Equal(t, "m1", points[0].Datapoint.Metric)
+	assert.NotEmpty(t, points[0].Error)
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPClientConf modelize the authentication, TLS and headers settings of an HTTP client
+type HTTPClientConf struct {
+	// Basic authentication user
+	BasicAuthUser string
+	// Basic authentication password
+	BasicAuthPassword string
+	// Bearer token
+	BearerToken string
+	// File containing the bearer token, reloaded when it changes
+	BearerTokenFile string
+	// CA bundle used to check the server certificate (PEM)
+	CAFile string
+	// Client certificate (PEM)
+	CertFile string
+	// Client certificate key (PEM)
+	KeyFile string
+	// Disables the server certificate check
+	InsecureSkipVerify bool
+	// Headers added to each request
+	Headers map[string]string
+}
+
+// newRoundTripper builds a RoundTripper applying the authentication, TLS and headers settings,
+// maxIdleConns is the maximum count of idle (keep-alive) connections kept open
+func newRoundTripper(c HTTPClientConf, maxIdleConns uint) (http.RoundTripper, error) {
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return nil, fmt.Errorf("bearer token and bearer token file are mutually exclusive")
+	}
+	if c.BasicAuthUser != "" && (c.BearerToken != "" || c.BearerTokenFile != "") {
+		return nil, fmt.Errorf("basic authentication and bearer token are mutually exclusive")
+	}
+	tlsConf, err := newTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	var rt http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConf,
+		MaxIdleConns:        int(maxIdleConns),
+		MaxIdleConnsPerHost: int(maxIdleConns),
+		IdleConnTimeout:     90 * time.Second,
+	}
+	switch {
+	case c.BasicAuthUser != "":
+		rt = basicAuthRoundTripper{user: c.BasicAuthUser, password: c.BasicAuthPassword, next: rt}
+	case c.BearerToken != "":
+		rt = bearerRoundTripper{token: staticToken(c.BearerToken), next: rt}
+	case c.BearerTokenFile != "":
+		f := &fileToken{path: c.BearerTokenFile}
+		if _, err := f.token(); err != nil {
+			return nil, err
+		}
+		rt = bearerRoundTripper{token: f.token, next: rt}
+	}
+	if len(c.Headers) > 0 {
+		rt = headersRoundTripper{headers: c.Headers, next: rt}
+	}
+	return rt, nil
+}
+
+func newTLSConfig(c HTTPClientConf) (*tls.Config, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading CA file '%v': %v", c.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in CA file '%v'", c.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading client certificate ('%v', '%v'): %v", c.CertFile, c.KeyFile, err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// cloneRequest copies a request before modifying its headers, as required by the RoundTripper contract
+func cloneRequest(r *http.Request) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		r2.Header[k] = append([]string(nil), v...)
+	}
+	return r2
+}
+
+type basicAuthRoundTripper struct {
+	user     string
+	password string
+	next     http.RoundTripper
+}
+
+func (rt basicAuthRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = cloneRequest(r)
+	r.SetBasicAuth(rt.user, rt.password)
+	return rt.next.RoundTrip(r)
+}
+
+type headersRoundTripper struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+func (rt headersRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = cloneRequest(r)
+	for k, v := range rt.headers {
+		r.Header.Set(k, v)
+	}
+	return rt.next.RoundTrip(r)
+}
+
+type contextKey string
+
+const headersContextKey contextKey = "headers"
+
+// withHeaders returns a context whose HTTP requests (made with a contextHeadersRoundTripper) get additional headers
+func withHeaders(ctx context.Context, headers map[string]string) context.Context {
+	if len(headers) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, headersContextKey, headers)
+}
+
+// contextHeadersRoundTripper adds the headers stored in the request context
+type contextHeadersRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt contextHeadersRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	headers, ok := r.Context().Value(headersContextKey).(map[string]string)
+	if !ok {
+		return rt.next.RoundTrip(r)
+	}
+	r = cloneRequest(r)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return rt.next.RoundTrip(r)
+}
+
+type bearerRoundTripper struct {
+	token func() (string, error)
+	next  http.RoundTripper
+}
+
+func (rt bearerRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	t, err := rt.token()
+	if err != nil {
+		return nil, err
+	}
+	r = cloneRequest(r)
+	r.Header.Set("Authorization", "Bearer "+t)
+	return rt.next.RoundTrip(r)
+}
+
+func staticToken(t string) func() (string, error) {
+	return func() (string, error) {
+		return t, nil
+	}
+}
+
+// fileToken reads a token from a file, the file is read again when its modification time changes
+type fileToken struct {
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	value   string
+}
+
+func (f *fileToken) token() (string, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("error while reading bearer token file '%v': %v", f.path, err)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if fi.ModTime().Equal(f.modTime) && f.value != "" {
+		return f.value, nil
+	}
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("error while reading bearer token file '%v': %v", f.path, err)
+	}
+	f.value = strings.TrimSpace(string(b))
+	f.modTime = fi.ModTime()
+	return f.value, nil
+}
@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeServerCA(t *testing.T, dir string, ts *httptest.Server) string {
+	path := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+	return path
+}
+
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "p2o"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func doGet(rt http.RoundTripper, url string) (*http.Response, error) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	return rt.RoundTrip(req)
+}
+
+func TestRoundTripperTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	caFile := writeServerCA(t, dir, ts)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	var tcs = []struct {
+		tcID   string
+		inConf HTTPClientConf
+		expOk  bool
+	}{
+		{"unknownCA", HTTPClientConf{CertFile: certFile, KeyFile: keyFile}, false},
+		{"noClientCert", HTTPClientConf{CAFile: caFile}, false},
+		{"caAndClientCert", HTTPClientConf{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, true},
+		{"insecure", HTTPClientConf{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}, true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			rt, err := newRoundTripper(tc.inConf, 1)
+			assert.Nil(t, err)
+			resp, err := doGet(rt, ts.URL)
+			assert.Equal(t, tc.expOk, err == nil)
+			if err == nil {
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestRoundTripperConfErrors(t *testing.T) {
+	var tcs = []struct {
+		tcID   string
+		inConf HTTPClientConf
+	}{
+		{"nonExistingCA", HTTPClientConf{CAFile: "nonExisting.pem"}},
+		{"invalidCA", HTTPClientConf{CAFile: "../testdata/confFiles/unparsable.json"}},
+		{"nonExistingCert", HTTPClientConf{CertFile: "nonExisting.pem", KeyFile: "nonExisting.key"}},
+		{"nonExistingTokenFile", HTTPClientConf{BearerTokenFile: "nonExisting.token"}},
+		{"tokenAndTokenFile", HTTPClientConf{BearerToken: "a", BearerTokenFile: "b"}},
+		{"basicAuthAndToken", HTTPClientConf{BasicAuthUser: "a", BearerToken: "b"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			_, err := newRoundTripper(tc.inConf, 1)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestRoundTripperAuthentication(t *testing.T) {
+	auth := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("fileToken\n"), 0600))
+
+	var tcs = []struct {
+		tcID    string
+		inConf  HTTPClientConf
+		expAuth string
+	}{
+		{"none", HTTPClientConf{}, ""},
+		{"basic", HTTPClientConf{BasicAuthUser: "user", BasicAuthPassword: "password"}, "Basic dXNlcjpwYXNzd29yZA=="},
+		{"bearer", HTTPClientConf{BearerToken: "token"}, "Bearer token"},
+		{"bearerFile", HTTPClientConf{BearerTokenFile: tokenFile}, "Bearer fileToken"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			rt, err := newRoundTripper(tc.inConf, 1)
+			assert.Nil(t, err)
+			resp, err := doGet(rt, ts.URL)
+			assert.Nil(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tc.expAuth, auth)
+		})
+	}
+}
+
+func TestBearerTokenFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("token1"), 0600))
+
+	f := &fileToken{path: path}
+	tok, err := f.token()
+	assert.Nil(t, err)
+	assert.Equal(t, "token1", tok)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("token2"), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(path, later, later))
+	tok, err = f.token()
+	assert.Nil(t, err)
+	assert.Equal(t, "token2", tok)
+}
+
+func TestNewPrometheusTLSError(t *testing.T) {
+	_, err := NewPrometheus(ExporterConf{PrometheusClient: HTTPClientConf{CAFile: "nonExisting.pem"}})
+	assert.NotNil(t, err)
+}
+
+func TestPrometheusQueryTLSAndBearer(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"k":"v"},"values":[[1564592490,"2"]]}]}}`))
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	c := ExporterConf{
+		PrometheusURL:    ts.URL,
+		PrometheusClient: HTTPClientConf{CAFile: writeServerCA(t, dir, ts), BearerToken: "token"},
+	}
+	p, err := NewPrometheus(c)
+	assert.Nil(t, err)
+	start := time.Unix(1564592490, 0)
+	o, _, err := collectQuery(context.Background(), p, QueryConf{MetricName: "m", Step: "30s", Start: start, End: start})
+	assert.Nil(t, err)
+	assert.Len(t, o, 1)
+}
+
+func TestRoundTripperHeaders(t *testing.T) {
+	headers := http.Header{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+	}))
+	defer ts.Close()
+
+	rt, err := newRoundTripper(HTTPClientConf{BearerToken: "token", Headers: map[string]string{"X-H1": "v1", "X-H2": "v2"}}, 1)
+	assert.Nil(t, err)
+	resp, err := doGet(rt, ts.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "v1", headers.Get("X-H1"))
+	assert.Equal(t, "v2", headers.Get("X-H2"))
+	assert.Equal(t, "Bearer token", headers.Get("Authorization"))
+}
+
+func TestOpentsdbPushTLSAndAuthentication(t *testing.T) {
+	mutex := sync.Mutex{}
+	newConns := 0
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "password" || r.Header.Get("X-Tenant") != "t1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"failed":0,"success":1}`))
+	}))
+	ts.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			mutex.Lock()
+			newConns++
+			mutex.Unlock()
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	c := ExporterConf{
+		OpentsdbURL: ts.URL,
+		BulkSize:    1,
+		ThreadCount: 2,
+		OpentsdbClient: HTTPClientConf{
+			CAFile:            writeServerCA(t, dir, ts),
+			BasicAuthUser:     "user",
+			BasicAuthPassword: "password",
+			Headers:           map[string]string{"X-Tenant": "t1"},
+		},
+	}
+	o, err := NewOpentsdb(c)
+	assert.Nil(t, err)
+	defer o.Close()
+	m := []OpentsdbMetric{}
+	for i := 0; i < 20; i++ {
+		m = append(m, OpentsdbMetric{Metric: "m", Timestamp: uint64(i), Value: 1})
+	}
+	assert.Nil(t, o.Push(context.Background(), m))
+	assert.Nil(t, o.Push(context.Background(), m))
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.True(t, newConns <= 2, "%v connections opened", newConns) // pooled connections
+}
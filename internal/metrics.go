@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
+	promCommon "github.com/prometheus/common/model"
+)
+
+const (
+	metricsNamespace = "prometheus_to_opentsdb"
+	// MetricsJob is the job of the metrics pushed to a Pushgateway
+	MetricsJob = "prometheus_to_opentsdb"
+
+	successQueryStatus = "success"
+	failureQueryStatus = "failure"
+)
+
+var (
+	// metricsRegistry gathers the metrics of the exporter (prometheus_to_opentsdb_*)
+	metricsRegistry = prometheus.NewRegistry()
+	// runtimeRegistry gathers the Go runtime and process metrics, they are only served by the daemon :
+	// node_exporter exports the same metrics, they would be duplicated by the textfile collector
+	runtimeRegistry = prometheus.NewRegistry()
+)
+
+var (
+	queriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queries_total",
+		Help:      "Count of executed queries, by query and status (success or failure).",
+	}, []string{"query", "status"})
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "prometheus_query_duration_seconds",
+		Help:      "Duration of the requests sent to Prometheus (a query split into several sub-queries sends several requests).",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"query"})
+	pointsReadCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "points_read_total",
+		Help:      "Count of datapoints read from Prometheus, by query.",
+	}, []string{"query"})
+	pointsPushedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "points_pushed_total",
+		Help:      "Count of datapoints successfully pushed, by sink type.",
+	}, []string{"sink"})
+	failedBulksCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "failed_bulks_total",
+		Help:      "Count of bulks that could not be pushed (after retries), by sink type.",
+	}, []string{"sink"})
+	pushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "push_duration_seconds",
+		Help:      "Duration of the push of a bulk (retries included), by sink type.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"sink"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		queriesCounter,
+		queryDuration,
+		pointsReadCounter,
+		pointsPushedCounter,
+		failedBulksCounter,
+		pushDuration,
+	)
+	runtimeRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// MetricsHandler serves the metrics of the exporter with the Go runtime and process metrics
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(prometheus.Gatherers{metricsRegistry, runtimeRegistry}, promhttp.HandlerOpts{})
+}
+
+// observePush records the outcome of the push of a bulk
+func observePush(sink string, bulk []OpentsdbMetric, start time.Time, err error) {
+	pushDuration.WithLabelValues(sink).Observe(time.Since(start).Seconds())
+	if err != nil {
+		failedBulksCounter.WithLabelValues(sink).Inc()
+		return
+	}
+	pointsPushedCounter.WithLabelValues(sink).Add(float64(len(bulk)))
+}
+
+// countSamples returns the count of datapoints of a Prometheus result
+func countSamples(v promCommon.Value) int {
+	switch r := v.(type) {
+	case promCommon.Matrix:
+		i := 0
+		for _, curSS := range r {
+			i += len(curSS.Values)
+		}
+		return i
+	case promCommon.Vector:
+		return len(r)
+	case *promCommon.Scalar:
+		return 1
+	}
+	return 0
+}
+
+// PushMetrics pushes the metrics of the exporter to a Pushgateway, replacing the metrics previously pushed with the same job
+func PushMetrics(url string) error {
+	if err := push.New(url, MetricsJob).Gatherer(metricsRegistry).Push(); err != nil {
+		return fmt.Errorf("error while pushing metrics to %v: %v", url, err)
+	}
+	return nil
+}
+
+// WriteMetrics writes the metrics of the exporter to a file in the Prometheus text format (node_exporter textfile collector),
+// the file is replaced atomically
+func WriteMetrics(file string) error {
+	mfs, err := metricsRegistry.Gather()
+	if err != nil {
+		return fmt.Errorf("error while gathering metrics: %v", err)
+	}
+	buf := bytes.Buffer{}
+	for _, curMf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, curMf); err != nil {
+			return fmt.Errorf("error while encoding metrics: %v", err)
+		}
+	}
+	if err := writeFileAtomically(file, buf.Bytes()); err != nil {
+		return fmt.Errorf("error while writing metrics: %v", err)
+	}
+	return nil
+}
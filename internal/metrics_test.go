@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	promCommon "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountSamples(t *testing.T) {
+	var tcs = []struct {
+		tcID  string
+		inV   promCommon.Value
+		expNb int
+	}{
+		{"matrix", promCommon.Matrix{
+			&promCommon.SampleStream{Values: []promCommon.SamplePair{buildSimplePair(1000, 1), buildSimplePair(2000, 2)}},
+			&promCommon.SampleStream{Values: []promCommon.SamplePair{buildSimplePair(1000, 1)}},
+		}, 3},
+		{"vector", promCommon.Vector{&promCommon.Sample{}, &promCommon.Sample{}}, 2},
+		{"scalar", &promCommon.Scalar{}, 1},
+		{"nil", nil, 0},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expNb, countSamples(tc.inV))
+		})
+	}
+}
+
+func TestQueryMetrics(t *testing.T) {
+	api := NewPromApiMock()
+	api.SetQueryRangeOutput(promCommon.Matrix{
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{"k": "v"}),
+			Values: []promCommon.SamplePair{buildSimplePair(1000, 1), buildSimplePair(2000, 2), buildSimplePair(3000, 3)},
+		},
+	}, nil, nil)
+	conf := QueryConf{Name: "TestQueryMetrics", MetricName: "blabla", Query: "q", Step: "1s", Start: time.Unix(1, 0), End: time.Unix(3, 0)}
+
+	read := testutil.ToFloat64(pointsReadCounter.WithLabelValues(conf.Name))
+	succeeded := testutil.ToFloat64(queriesCounter.WithLabelValues(conf.Name, successQueryStatus))
+	failed := testutil.ToFloat64(queriesCounter.WithLabelValues(conf.Name, failureQueryStatus))
+
+	_, _, err := collectQuery(context.Background(), Prometheus{api: api}, conf)
+	assert.Nil(t, err)
+	assert.Equal(t, read+3, testutil.ToFloat64(pointsReadCounter.WithLabelValues(conf.Name)))
+	assert.Equal(t, succeeded+1, testutil.ToFloat64(queriesCounter.WithLabelValues(conf.Name, successQueryStatus)))
+	assert.Equal(t, failed, testutil.ToFloat64(queriesCounter.WithLabelValues(conf.Name, failureQueryStatus)))
+
+	api.SetQueryRangeOutput(nil, nil, fmt.Errorf("error"))
+	_, _, err = collectQuery(context.Background(), Prometheus{api: api}, conf)
+	assert.NotNil(t, err)
+	assert.Equal(t, failed+1, testutil.ToFloat64(queriesCounter.WithLabelValues(conf.Name, failureQueryStatus)))
+}
+
+func TestPushBulksMetrics(t *testing.T) {
+	pushed := testutil.ToFloat64(pointsPushedCounter.WithLabelValues(opentsdbSinkType))
+	failed := testutil.ToFloat64(failedBulksCounter.WithLabelValues(opentsdbSinkType))
+	m := []OpentsdbMetric{{Metric: "m1"}, {Metric: "m2"}, {Metric: "m3"}}
+	err := pushBulks(context.TODO(), singleBulk(m), opentsdbSinkType, 2, 1, nil, func(ctx context.Context, bulk []OpentsdbMetric) error {
+		if len(bulk) == 1 {
+			return fmt.Errorf("error")
+		}
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, pushed+2, testutil.ToFloat64(pointsPushedCounter.WithLabelValues(opentsdbSinkType)))
+	assert.Equal(t, failed+1, testutil.ToFloat64(failedBulksCounter.WithLabelValues(opentsdbSinkType)))
+}
+
+func TestWriteMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "p2o.prom")
+	pointsPushedCounter.WithLabelValues(opentsdbSinkType).Add(0)
+
+	assert.Nil(t, WriteMetrics(file))
+	content, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), `prometheus_to_opentsdb_points_pushed_total{sink="opentsdb"}`)
+	assert.NotContains(t, string(content), "go_goroutines") // exported by node_exporter
+	assert.NotContains(t, string(content), "process_")
+	fi, err := os.Stat(file)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm()) // readable by node_exporter
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1) // no temporary file left
+
+	assert.NotNil(t, WriteMetrics(filepath.Join(dir, "unknown", "p2o.prom")))
+}
+
+func TestPushMetrics(t *testing.T) {
+	var method, path, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+	pointsPushedCounter.WithLabelValues(opentsdbSinkType).Add(0)
+
+	assert.Nil(t, PushMetrics(ts.URL))
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, "/metrics/job/"+MetricsJob, path)
+	assert.True(t, strings.Contains(body, "prometheus_to_opentsdb_points_pushed_total"))
+	assert.False(t, strings.Contains(body, "go_goroutines"))
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	assert.NotNil(t, PushMetrics(failing.URL))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	pointsPushedCounter.WithLabelValues(opentsdbSinkType).Add(0)
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "prometheus_to_opentsdb_points_pushed_total")
+	assert.Contains(t, rec.Body.String(), "go_goroutines")
+}
@@ -2,12 +2,16 @@ package internal
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
-	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,59 +24,266 @@ const (
 	defaultThreadCount    uint          = 1
 	defaultPushTimeout    time.Duration = time.Minute
 	routierIdKey          string        = "routineId"
+
+	defaultPushMaxAttempts    uint          = 3
+	defaultPushInitialBackoff time.Duration = 500 * time.Millisecond
+	defaultPushMaxBackoff     time.Duration = 30 * time.Second
+)
+
+var defaultPushRetryStatusCodes = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// gzip writers and buffers are pooled so that pushers don't allocate them for each bulk
+var (
+	gzipWriterPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	gzipBufferPool = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
 )
 
 // Opentsdb is an Opentsdb connector
 type Opentsdb struct {
+	pushSettings
 	opentsdbURL string
+	gzip        bool
+	client      *http.Client
+}
+
+// pushSettings are the settings shared by the Opentsdb connectors (http and telnet)
+type pushSettings struct {
 	bulkSize    uint
 	threadCount uint
 	pushTimeout time.Duration
+	retry       retryPolicy
+	deadLetter  *DeadLetter
+	integer     bool
+}
+
+// retryPolicy describes how a bulk push is retried on transient errors
+type retryPolicy struct {
+	maxAttempts    uint
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	statusCodes    map[int]bool
+}
+
+// backoff computes the delay before the next attempt : exponential backoff with jitter
+func (r retryPolicy) backoff(attempt uint) time.Duration {
+	d := r.initialBackoff
+	for i := uint(1); i < attempt && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do executes attempt until it succeeds, returns a non-retryable error or the max attempts count is reached
+func (r retryPolicy) do(ctx context.Context, attempt func() (bool, error)) error {
+	for i := uint(1); ; i++ {
+		retryable, err := attempt()
+		if err == nil || !retryable || i >= r.maxAttempts {
+			return err
+		}
+		backoff := r.backoff(i)
+		logrus.Warnf("pusher %v, attempt %v/%v failed, retrying in %v: %v", ctx.Value(routierIdKey), i, r.maxAttempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("pusher %v, push canceled: %v (last error: %v)", ctx.Value(routierIdKey), ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+	}
 }
 
 type opentsbResponse struct {
-	Failed  uint `json:"failed"`
-	Success uint `json:"success"`
+	Failed  uint            `json:"failed"`
+	Success uint            `json:"success"`
+	Errors  []RejectedPoint `json:"errors"`
+}
+
+// RejectedPoint is a datapoint rejected by Opentsdb
+type RejectedPoint struct {
+	// Datapoint is the rejected datapoint
+	Datapoint OpentsdbMetric `json:"datapoint"`
+	// Error is the reason of the rejection
+	Error string `json:"error"`
+}
+
+// FailedBulk is a bulk that could not be pushed to Opentsdb
+type FailedBulk struct {
+	// Metrics are the metrics of the bulk
+	Metrics []OpentsdbMetric
+	// Err is the reason of the failure
+	Err error
+}
+
+// PushError is the report returned by Push when some datapoints have not been stored
+type PushError struct {
+	// Rejected lists the datapoints rejected by Opentsdb
+	Rejected []RejectedPoint
+	// FailedBulks lists the bulks that could not be pushed at all
+	FailedBulks []FailedBulk
+}
+
+func (e *PushError) Error() string {
+	reasons := make(map[string]int)
+	for _, curRej := range e.Rejected {
+		reasons[curRej.Error]++
+	}
+	reasonDescs := []string{}
+	for curReason, count := range reasons {
+		reasonDescs = append(reasonDescs, fmt.Sprintf("%v: %v", curReason, count))
+	}
+	sort.Strings(reasonDescs)
+	return fmt.Sprintf("%v points rejected by Opentsdb [%v], %v bulks failed",
+		len(e.Rejected), strings.Join(reasonDescs, ", "), len(e.FailedBulks))
+}
+
+// Points lists every datapoint that has not been stored (rejected or part of a failed bulk) with its failure reason
+func (e *PushError) Points() []RejectedPoint {
+	points := append([]RejectedPoint{}, e.Rejected...)
+	for _, curBulk := range e.FailedBulks {
+		for _, curMetric := range curBulk.Metrics {
+			points = append(points, RejectedPoint{Datapoint: curMetric, Error: curBulk.Err.Error()})
+		}
+	}
+	return points
+}
+
+func (e *PushError) merge(bulk []OpentsdbMetric, err error) {
+	if pErr, ok := err.(*PushError); ok {
+		e.Rejected = append(e.Rejected, pErr.Rejected...)
+		e.FailedBulks = append(e.FailedBulks, pErr.FailedBulks...)
+		return
+	}
+	e.FailedBulks = append(e.FailedBulks, FailedBulk{Metrics: bulk, Err: err})
 }
 
 // NewOpentsdb instanciates an Opentsdb connector
 func NewOpentsdb(c ExporterConf) (Opentsdb, error) {
 	o := Opentsdb{
 		opentsdbURL: c.OpentsdbURL + opentsdbRestApiSuffix,
+		gzip:        c.PushGzip,
+	}
+	var err error
+	if o.pushSettings, err = newPushSettings(c); err != nil {
+		return o, err
+	}
+	rt, err := newRoundTripper(c.OpentsdbClient, o.threadCount)
+	if err != nil {
+		return o, fmt.Errorf("error while initializing Opentsdb http client: %v", err)
+	}
+	o.client = &http.Client{
+		Timeout:   o.pushTimeout,
+		Transport: rt,
+	}
+	return o, nil
+}
+
+// newPushSettings reads the push settings of an exporter configuration, the default values are used if they are not provided
+func newPushSettings(c ExporterConf) (pushSettings, error) {
+	p := pushSettings{
 		bulkSize:    c.BulkSize,
 		threadCount: c.ThreadCount,
+		integer:     !c.FloatValues,
 	}
 	if c.BulkSize == 0 {
 		logrus.Infof("Default bulk size will be used: %v", defaultBulkSize)
-		o.bulkSize = defaultBulkSize
+		p.bulkSize = defaultBulkSize
 	}
 	if c.ThreadCount == 0 {
 		logrus.Infof("Default thread count will be used: %v", defaultThreadCount)
-		o.threadCount = defaultThreadCount
+		p.threadCount = defaultThreadCount
 	}
 	var err error
 	switch c.PushTimeout {
 	case "":
 		logrus.Infof("Default push timeout will be used: %v", defaultPushTimeout)
-		o.pushTimeout = defaultPushTimeout
+		p.pushTimeout = defaultPushTimeout
 	default:
-		if o.pushTimeout, err = time.ParseDuration(c.PushTimeout); err != nil {
-			return o, fmt.Errorf("error while parsing push timeout duration (%v): %v", c.PushTimeout, err)
+		if p.pushTimeout, err = time.ParseDuration(c.PushTimeout); err != nil {
+			return p, fmt.Errorf("error while parsing push timeout duration (%v): %v", c.PushTimeout, err)
 		}
 	}
-	return o, nil
+	if p.retry, err = newRetryPolicy(c); err != nil {
+		return p, err
+	}
+	if c.DeadLetterFile != "" {
+		d := NewDeadLetter(c.DeadLetterFile)
+		p.deadLetter = &d
+	}
+	return p, nil
+}
+
+func newRetryPolicy(c ExporterConf) (retryPolicy, error) {
+	r := retryPolicy{
+		maxAttempts:    c.PushMaxAttempts,
+		initialBackoff: defaultPushInitialBackoff,
+		maxBackoff:     defaultPushMaxBackoff,
+		statusCodes:    make(map[int]bool),
+	}
+	if c.PushMaxAttempts == 0 {
+		logrus.Infof("Default push max attempts will be used: %v", defaultPushMaxAttempts)
+		r.maxAttempts = defaultPushMaxAttempts
+	}
+	var err error
+	if c.PushInitialBackoff != "" {
+		if r.initialBackoff, err = time.ParseDuration(c.PushInitialBackoff); err != nil {
+			return r, fmt.Errorf("error while parsing push initial backoff duration (%v): %v", c.PushInitialBackoff, err)
+		}
+	}
+	if c.PushMaxBackoff != "" {
+		if r.maxBackoff, err = time.ParseDuration(c.PushMaxBackoff); err != nil {
+			return r, fmt.Errorf("error while parsing push max backoff duration (%v): %v", c.PushMaxBackoff, err)
+		}
+	}
+	codes := c.PushRetryStatusCodes
+	if codes == nil {
+		codes = defaultPushRetryStatusCodes
+	}
+	for _, curCode := range codes {
+		r.statusCodes[curCode] = true
+	}
+	return r, nil
 }
 
-// Push pushes metrics to Opentsdb
+// Push pushes metrics to Opentsdb, a *PushError is returned if some metrics have not been stored
 func (o Opentsdb) Push(ctx context.Context, m []OpentsdbMetric) error {
-	logrus.SetLevel(logrus.DebugLevel)
-	tasks := make(chan []OpentsdbMetric, o.threadCount)
+	return pushBulks(ctx, singleBulk(m), opentsdbSinkType, o.bulkSize, o.threadCount, o.deadLetter, o.doPush)
+}
+
+// PushStream pushes the bulks of metrics received from a channel as they arrive, until it is closed,
+// a *PushError is returned if some metrics have not been stored
+func (o Opentsdb) PushStream(ctx context.Context, bulks <-chan []OpentsdbMetric) error {
+	return pushBulks(ctx, bulks, opentsdbSinkType, o.bulkSize, o.threadCount, o.deadLetter, o.doPush)
+}
+
+// singleBulk returns a closed channel holding metrics as a single bulk
+func singleBulk(m []OpentsdbMetric) <-chan []OpentsdbMetric {
+	bulks := make(chan []OpentsdbMetric, 1)
+	bulks <- m
+	close(bulks)
+	return bulks
+}
+
+// pushBulks splits the received metrics into bulks that are pushed by threadCount goroutines (the goroutine id is stored in the context)
+// until the channel is closed, a *PushError is returned if some metrics have not been stored.
+// The pushes are recorded in the exporter metrics, labeled with the sink type
+func pushBulks(ctx context.Context, bulks <-chan []OpentsdbMetric, sink string, bulkSize uint, threadCount uint, deadLetter *DeadLetter, push func(ctx context.Context, bulk []OpentsdbMetric) error) error {
+	tasks := make(chan []OpentsdbMetric, threadCount)
 	wg := sync.WaitGroup{}
-	wg.Add(int(o.threadCount))
-	errOccured := false
+	wg.Add(int(threadCount))
+	pushErr := PushError{}
+	mutex := sync.Mutex{}
 
 	// consumer
-	for i := uint(0); i < o.threadCount; i++ {
+	for i := uint(0); i < threadCount; i++ {
 		thId := i
 		go func() {
 			thIdLocal := thId
@@ -80,71 +291,137 @@ func (o Opentsdb) Push(ctx context.Context, m []OpentsdbMetric) error {
 			defer wg.Done()
 			for curTask := range tasks {
 				logrus.Debugf("pusher %v, curTask: %v", thIdLocal, curTask)
-				if err := o.doPush(subCtx, curTask); err != nil {
-					errOccured = true
+				start := time.Now()
+				err := push(subCtx, curTask)
+				observePush(sink, curTask, start, err)
+				if err != nil {
 					logrus.Errorf("error while pushing to Opentsdb: %v", err)
+					mutex.Lock()
+					pushErr.merge(curTask, err)
+					mutex.Unlock()
 				}
 			}
 		}()
 	}
 
 	// provider
-	start, end := uint(0), uint(0)
-	length := uint(len(m))
-	for end < length {
-		end += o.bulkSize
-		if end > length {
-			end = length
+	for m := range bulks {
+		start, end := uint(0), uint(0)
+		length := uint(len(m))
+		for end < length {
+			end += bulkSize
+			if end > length {
+				end = length
+			}
+			logrus.Debugf("new task, %v to %v, total: %v", start+1, end, length)
+			tasks <- m[start:end]
+			start = end
 		}
-		logrus.Debugf("new task, %v to %v, total: %v", start+1, end, length)
-		tasks <- m[start:end]
-		start = end
 	}
 	close(tasks)
 
 	wg.Wait()
 	logrus.Debugf("Push finished")
 
-	if errOccured {
-		return fmt.Errorf("Some errors occured while pushing to opentsdb")
+	if len(pushErr.Rejected) > 0 || len(pushErr.FailedBulks) > 0 {
+		if deadLetter != nil {
+			if err := deadLetter.Append(&pushErr); err != nil {
+				logrus.Errorf("error while writing to dead letter file: %v", err)
+			}
+		}
+		return &pushErr
+	}
+	return nil
+}
+
+// Close releases the resources of the connector
+func (o Opentsdb) Close() error {
+	if o.client != nil {
+		o.client.CloseIdleConnections()
 	}
 	return nil
 }
 
+// doPush pushes a bulk to Opentsdb, retrying on transient errors
 func (o Opentsdb) doPush(ctx context.Context, m []OpentsdbMetric) error {
-	data, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("pusher %v, error while marshaling data: %v", ctx.Value(routierIdKey), err)
+	buf := bulkBufferPool.Get().(*[]byte)
+	defer bulkBufferPool.Put(buf)
+	*buf = appendJSONPoints((*buf)[:0], m, o.integer)
+	data := *buf
+
+	if o.gzip {
+		buf := gzipBufferPool.Get().(*bytes.Buffer)
+		defer gzipBufferPool.Put(buf)
+		if err := gzipData(data, buf); err != nil {
+			return fmt.Errorf("pusher %v, error while compressing data: %v", ctx.Value(routierIdKey), err)
+		}
+		data = buf.Bytes()
+	}
+
+	return o.retry.do(ctx, func() (bool, error) {
+		return o.doPushAttempt(ctx, data, len(m))
+	})
+}
+
+// gzipData compresses data into buf using a pooled gzip writer
+func gzipData(data []byte, buf *bytes.Buffer) error {
+	buf.Reset()
+	w := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return err
 	}
+	return w.Close()
+}
+
+// doPushAttempt sends a bulk once, it returns whether the error is transient
+func (o Opentsdb) doPushAttempt(ctx context.Context, data []byte, count int) (bool, error) {
 	req, err := http.NewRequest(http.MethodPost, o.opentsdbURL, bytes.NewBuffer(data))
+	if err != nil {
+		return false, fmt.Errorf("pusher %v, error while building request: %v", ctx.Value(routierIdKey), err)
+	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{
-		Timeout: o.pushTimeout,
+	if o.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
 	}
-	resp, err := client.Do(req)
+
+	resp, err := o.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("pusher %v, error while pushing data: %v", ctx.Value(routierIdKey), err)
+		return ctx.Err() == nil, fmt.Errorf("pusher %v, error while pushing data: %v", ctx.Value(routierIdKey), err)
 	}
-	defer resp.Body.Close()
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body) // the connection is only reused once the body has been read
+		resp.Body.Close()
+	}()
 
 	if resp.StatusCode == 200 {
-		logrus.Debugf("pusher %v, pushed %v points with success", ctx.Value(routierIdKey), len(m))
-		return nil
+		logrus.Debugf("pusher %v, pushed %v points with success", ctx.Value(routierIdKey), count)
+		return false, nil
 	}
 
 	logrus.Warnf("pusher %v, opentsdb HTTP status: %v", ctx.Value(routierIdKey), resp.Status)
 	respCont, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("pusher %v, error while reading response: %v", ctx.Value(routierIdKey), err)
+		return true, fmt.Errorf("pusher %v, error while reading response: %v", ctx.Value(routierIdKey), err)
+	}
+	if o.retry.statusCodes[resp.StatusCode] {
+		return true, fmt.Errorf("pusher %v, opentsdb HTTP status: %v", ctx.Value(routierIdKey), resp.Status)
 	}
-	fmt.Fprintf(os.Stderr, "%v", string(respCont))
+	logrus.Debugf("pusher %v, opentsdb response: %v", ctx.Value(routierIdKey), string(respCont))
 
 	oResp := opentsbResponse{}
 	err = json.Unmarshal(respCont, &oResp)
 	if err != nil {
-		return fmt.Errorf("pusher %v, error while parsing response: %v", ctx.Value(routierIdKey), err)
+		return false, fmt.Errorf("pusher %v, error while parsing response: %v", ctx.Value(routierIdKey), err)
 	}
 	logrus.Warnf("pusher %v, Opentsdb rejected metrics: %v", ctx.Value(routierIdKey), oResp.Failed)
-	return fmt.Errorf("pusher %v, some metrics have been rejected (%v)", ctx.Value(routierIdKey), oResp.Failed)
+	if len(oResp.Errors) == 0 {
+		return false, fmt.Errorf("pusher %v, some metrics have been rejected (%v)", ctx.Value(routierIdKey), oResp.Failed)
+	}
+	for _, curRej := range oResp.Errors {
+		logrus.Debugf("pusher %v, rejected datapoint %v: %v", ctx.Value(routierIdKey), curRej.Datapoint, curRej.Error)
+	}
+	return false, &PushError{Rejected: oResp.Errors}
 }
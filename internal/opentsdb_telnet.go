@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OpentsdbTelnet is an Opentsdb connector using the telnet-style put protocol,
+// each pusher goroutine owns a persistent TCP connection
+type OpentsdbTelnet struct {
+	pushSettings
+	address string
+	conns   []*telnetConn
+}
+
+// telnetConn is a persistent connection, (re)opened when needed
+type telnetConn struct {
+	mutex  sync.Mutex
+	conn   net.Conn
+	closed chan struct{}
+}
+
+// NewOpentsdbTelnet instanciates a telnet-style Opentsdb connector, address is host:port
+func NewOpentsdbTelnet(c ExporterConf, address string) (OpentsdbTelnet, error) {
+	t := OpentsdbTelnet{address: address}
+	var err error
+	if t.pushSettings, err = newPushSettings(c); err != nil { // same settings as the HTTP connector
+		return t, err
+	}
+	t.conns = make([]*telnetConn, t.threadCount)
+	for i := range t.conns {
+		t.conns[i] = &telnetConn{}
+	}
+	return t, nil
+}
+
+// Push pushes metrics to Opentsdb, a *PushError is returned if some metrics have not been sent
+func (t OpentsdbTelnet) Push(ctx context.Context, m []OpentsdbMetric) error {
+	return pushBulks(ctx, singleBulk(m), opentsdbTelnetSinkType, t.bulkSize, t.threadCount, t.deadLetter, t.doPush)
+}
+
+// PushStream pushes the bulks of metrics received from a channel as they arrive, until it is closed
+func (t OpentsdbTelnet) PushStream(ctx context.Context, bulks <-chan []OpentsdbMetric) error {
+	return pushBulks(ctx, bulks, opentsdbTelnetSinkType, t.bulkSize, t.threadCount, t.deadLetter, t.doPush)
+}
+
+// Close closes the connections
+func (t OpentsdbTelnet) Close() error {
+	for _, curConn := range t.conns {
+		curConn.mutex.Lock()
+		curConn.close()
+		curConn.mutex.Unlock()
+	}
+	return nil
+}
+
+func (t OpentsdbTelnet) doPush(ctx context.Context, m []OpentsdbMetric) error {
+	buf := bulkBufferPool.Get().(*[]byte)
+	defer bulkBufferPool.Put(buf)
+	*buf = appendPuts((*buf)[:0], m, t.integer)
+	data := *buf
+	tc := t.conns[ctx.Value(routierIdKey).(uint)]
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	return t.retry.do(ctx, func() (bool, error) {
+		if err := tc.write(t.address, data, t.pushTimeout); err != nil {
+			tc.close() // reconnect on next attempt
+			return ctx.Err() == nil, fmt.Errorf("pusher %v, error while pushing data: %v", ctx.Value(routierIdKey), err)
+		}
+		logrus.Debugf("pusher %v, sent %v points", ctx.Value(routierIdKey), len(m))
+		return false, nil
+	})
+}
+
+// write sends data, the connection is opened if needed or if it has been closed by Opentsdb
+func (tc *telnetConn) write(address string, data []byte, timeout time.Duration) error {
+	if tc.conn != nil {
+		select {
+		case <-tc.closed:
+			tc.close()
+		default:
+		}
+	}
+	if tc.conn == nil {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return fmt.Errorf("error while connecting to %v: %v", address, err)
+		}
+		tc.conn = conn
+		tc.closed = make(chan struct{})
+		go readResponses(conn, tc.closed)
+	}
+	if err := tc.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	_, err := tc.conn.Write(data)
+	return err
+}
+
+func (tc *telnetConn) close() {
+	if tc.conn != nil {
+		tc.conn.Close()
+		tc.conn = nil
+	}
+}
+
+// readResponses logs the errors sent back by Opentsdb (nothing is sent on success) until the connection is closed
+func readResponses(conn net.Conn, closed chan struct{}) {
+	defer close(closed)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		logrus.Warnf("opentsdb %v: %v", conn.RemoteAddr(), scanner.Text())
+	}
+}
+
+// appendPuts appends the put lines of metrics to buf : put <metric> <timestamp> <value> <tagk1=tagv1 ...>
+func appendPuts(buf []byte, m []OpentsdbMetric, integer bool) []byte {
+	for _, curMetric := range m {
+		buf = append(buf, "put "...)
+		buf = append(buf, curMetric.Metric...)
+		buf = append(buf, ' ')
+		buf = strconv.AppendUint(buf, curMetric.Timestamp, 10)
+		buf = append(buf, ' ')
+		buf = appendValue(buf, curMetric.Value, integer)
+		buf = append(buf, curMetric.tagsEncoding().telnet...)
+		buf = append(buf, '\n')
+	}
+	return buf
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// telnetStub is a local TCP server that collects put lines, it closes each connection after closeAfter lines (0 : never)
+type telnetStub struct {
+	listener net.Listener
+	lines    chan string
+	conns    chan net.Conn
+}
+
+func newTelnetStub(t *testing.T, closeAfter int) telnetStub {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := telnetStub{listener: l, lines: make(chan string, 100), conns: make(chan net.Conn, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- conn
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for i := 1; scanner.Scan(); i++ {
+					s.lines <- scanner.Text()
+					if i == closeAfter {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s telnetStub) next(t *testing.T) string {
+	select {
+	case l := <-s.lines:
+		return l
+	case <-time.After(time.Second):
+		assert.Fail(t, "no line received")
+		return ""
+	}
+}
+
+func TestAppendPuts(t *testing.T) {
+	m := []OpentsdbMetric{
+		{Metric: "m1", Timestamp: 42, Value: 1.5, Tags: map[string]string{"k2": "v2", "k1": "v1"}},
+		{Metric: "m2", Timestamp: 43, Value: 2},
+	}
+	assert.Equal(t, "put m1 42 1.5 k1=v1 k2=v2\nput m2 43 2.0\n", string(appendPuts(nil, m, false)))
+	assert.Equal(t, "put m1 42 1.5 k1=v1 k2=v2\nput m2 43 2\n", string(appendPuts(nil, m, true)))
+	assert.Equal(t, "prefix put m2 43 2\n", string(appendPuts([]byte("prefix "), m[1:], true)))
+}
+
+func TestNewOpentsdbTelnet(t *testing.T) {
+	// the HTTP client settings are not used by the telnet connector
+	o, err := NewOpentsdbTelnet(ExporterConf{OpentsdbClient: HTTPClientConf{CAFile: "unknown.pem"}}, "127.0.0.1:4242")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultBulkSize, o.bulkSize)
+	assert.Equal(t, defaultThreadCount, o.threadCount)
+	assert.Equal(t, defaultPushTimeout, o.pushTimeout)
+	assert.Len(t, o.conns, int(defaultThreadCount))
+
+	_, err = NewOpentsdbTelnet(ExporterConf{PushTimeout: "blabla"}, "127.0.0.1:4242")
+	assert.NotNil(t, err)
+}
+
+func TestOpentsdbTelnetPush(t *testing.T) {
+	stub := newTelnetStub(t, 0)
+	defer stub.listener.Close()
+
+	o, err := NewOpentsdbTelnet(ExporterConf{BulkSize: 1, ThreadCount: 2}, stub.listener.Addr().String())
+	assert.Nil(t, err)
+	defer o.Close()
+
+	m := []OpentsdbMetric{
+		{Metric: "m1", Timestamp: 42, Value: 1.5, Tags: map[string]string{"k": "v"}},
+		{Metric: "m2", Timestamp: 43, Value: 2.5, Tags: map[string]string{"k": "v"}},
+		{Metric: "m3", Timestamp: 44, Value: 3.5, Tags: map[string]string{"k": "v"}},
+	}
+	assert.Nil(t, o.Push(context.TODO(), m))
+	assert.Nil(t, o.Push(context.TODO(), m))
+	lines := []string{}
+	for i := 0; i < 6; i++ {
+		lines = append(lines, stub.next(t))
+	}
+	assert.ElementsMatch(t, []string{
+		"put m1 42 1.5 k=v", "put m2 43 2.5 k=v", "put m3 44 3.5 k=v",
+		"put m1 42 1.5 k=v", "put m2 43 2.5 k=v", "put m3 44 3.5 k=v",
+	}, lines)
+	assert.True(t, len(stub.conns) <= 2) // persistent connections : one per pusher
+}
+
+func TestOpentsdbTelnetReconnect(t *testing.T) {
+	stub := newTelnetStub(t, 1)
+	defer stub.listener.Close()
+
+	o, err := NewOpentsdbTelnet(ExporterConf{}, stub.listener.Addr().String())
+	assert.Nil(t, err)
+	defer o.Close()
+
+	assert.Nil(t, o.Push(context.TODO(), []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1}}))
+	assert.Equal(t, "put m1 42 1", stub.next(t))
+	time.Sleep(50 * time.Millisecond) // connection closed by the server
+	assert.Nil(t, o.Push(context.TODO(), []OpentsdbMetric{{Metric: "m2", Timestamp: 43, Value: 2}}))
+	assert.Equal(t, "put m2 43 2", stub.next(t))
+	assert.Len(t, stub.conns, 2)
+}
+
+func TestOpentsdbTelnetUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	c := ExporterConf{PushMaxAttempts: 2, PushInitialBackoff: "1ms", PushTimeout: "100ms"}
+	o, err := NewOpentsdbTelnet(c, addr)
+	assert.Nil(t, err)
+	defer o.Close()
+
+	err = o.Push(context.TODO(), []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1}})
+	assert.NotNil(t, err)
+	pErr, ok := err.(*PushError)
+	assert.True(t, ok)
+	assert.Len(t, pErr.FailedBulks, 1)
+}
@@ -1,13 +1,18 @@
 package internal
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,6 +23,100 @@ func TestNewOpentsdbDefaultValues(t *testing.T) {
 	assert.Equal(t, defaultBulkSize, o.bulkSize)
 	assert.Equal(t, defaultThreadCount, o.threadCount)
 	assert.Equal(t, defaultPushTimeout, o.pushTimeout)
+	assert.True(t, o.integer) // integral values are sent as integers, like the previous versions
+	assert.Equal(t, defaultPushMaxAttempts, o.retry.maxAttempts)
+	assert.Equal(t, defaultPushInitialBackoff, o.retry.initialBackoff)
+	assert.Equal(t, defaultPushMaxBackoff, o.retry.maxBackoff)
+	assert.True(t, o.retry.statusCodes[http.StatusServiceUnavailable])
+	assert.False(t, o.retry.statusCodes[http.StatusBadRequest])
+}
+
+func TestNewOpentsdbUnparsableBackoff(t *testing.T) {
+	_, err := NewOpentsdb(ExporterConf{PushInitialBackoff: "blabla"})
+	assert.NotNil(t, err)
+	_, err = NewOpentsdb(ExporterConf{PushMaxBackoff: "blabla"})
+	assert.NotNil(t, err)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	r := retryPolicy{initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	var tcs = []struct {
+		tcID       string
+		inAttempt  uint
+		expMinimum time.Duration
+		expMaximum time.Duration
+	}{
+		{"1", 1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"2", 2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{"3", 3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{"capped", 10, 500 * time.Millisecond, time.Second},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				d := r.backoff(tc.inAttempt)
+				assert.True(t, d >= tc.expMinimum && d <= tc.expMaximum, "%v not in [%v, %v]", d, tc.expMinimum, tc.expMaximum)
+			}
+		})
+	}
+}
+
+func TestDoPushRetry(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inStatuses  []int
+		expOK       bool
+		expAttempts int
+	}{
+		{"firstAttempt", []int{http.StatusOK}, true, 1},
+		{"transientError", []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, true, 3},
+		{"tooManyErrors", []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}, false, 3},
+		{"notRetryable", []int{http.StatusBadRequest}, false, 1},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			attempts := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.inStatuses[attempts])
+				attempts++
+				io.WriteString(w, "{ \"failed\":0, \"success\":1 }")
+			}))
+			defer ts.Close()
+
+			c := ExporterConf{
+				OpentsdbURL:        ts.URL,
+				PushMaxAttempts:    3,
+				PushInitialBackoff: "1ms",
+				PushMaxBackoff:     "5ms",
+			}
+			o, err := NewOpentsdb(c)
+			assert.Nil(t, err)
+
+			err = o.doPush(context.TODO(), []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1.3}})
+			assert.Equal(t, tc.expOK, err == nil)
+			assert.Equal(t, tc.expAttempts, attempts)
+		})
+	}
+}
+
+func TestDoPushRetryCanceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c := ExporterConf{
+		OpentsdbURL:        ts.URL,
+		PushMaxAttempts:    10,
+		PushInitialBackoff: "1h",
+	}
+	o, err := NewOpentsdb(c)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = o.doPush(ctx, []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1.3}})
+	assert.NotNil(t, err)
 }
 
 func TestNewOpentsdbUnparsableTimeout(t *testing.T) {
@@ -38,6 +137,7 @@ func TestDoPush(t *testing.T) {
 		{"nominal", http.StatusOK, "{ \"failed\":0, \"success\":2 }", true},
 		{"errorParsable", http.StatusBadRequest, "{ \"failed\":1, \"success\":0 }", false},
 		{"errorUnparsable", http.StatusBadRequest, "{", false},
+		{"errorDetails", http.StatusBadRequest, "{ \"failed\":1, \"success\":0, \"errors\":[{\"datapoint\":{\"metric\":\"blabla\"},\"error\":\"e\"}] }", false},
 	}
 	for _, tc := range tcs {
 		t.Run(tc.tcID, func(t *testing.T) {
@@ -156,3 +256,268 @@ func TestPushNominal(t *testing.T) {
 		})
 	}
 }
+
+func TestPushKeepsLoggingLevel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"failed":0,"success":1}`)
+	}))
+	defer ts.Close()
+	lvl := logrus.GetLevel()
+	defer logrus.SetLevel(lvl)
+	logrus.SetLevel(logrus.WarnLevel)
+
+	o, err := NewOpentsdb(ExporterConf{OpentsdbURL: ts.URL})
+	assert.Nil(t, err)
+	assert.Nil(t, o.Push(context.TODO(), []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1}}))
+	assert.Equal(t, logrus.WarnLevel, logrus.GetLevel())
+}
+
+func TestPushReport(t *testing.T) {
+	responses := []struct {
+		status int
+		body   string
+	}{
+		{http.StatusBadRequest, `{"failed":1,"success":0,"errors":[{"datapoint":{"metric":"m1","timestamp":42,"value":1.3,"tags":{"k":"v"}},"error":"Unable to find UID for metric"}]}`},
+		{http.StatusOK, `{"failed":0,"success":1}`},
+		{http.StatusBadRequest, `{"failed":1,"success":0}`},
+	}
+	i := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(responses[i].status)
+		io.WriteString(w, responses[i].body)
+		i++
+	}))
+	defer ts.Close()
+
+	m := []OpentsdbMetric{
+		{Metric: "m1", Timestamp: 42, Value: 1.3, Tags: map[string]string{"k": "v"}},
+		{Metric: "m2", Timestamp: 43, Value: 1.4},
+		{Metric: "m3", Timestamp: 44, Value: 1.5},
+	}
+	o, err := NewOpentsdb(ExporterConf{OpentsdbURL: ts.URL, BulkSize: 1})
+	assert.Nil(t, err)
+
+	err = o.Push(context.TODO(), m)
+	assert.NotNil(t, err)
+	pErr, ok := err.(*PushError)
+	assert.True(t, ok)
+	assert.Len(t, pErr.Rejected, 1)
+	assert.Equal(t, m[0], pErr.Rejected[0].Datapoint)
+	assert.Equal(t, "Unable to find UID for metric", pErr.Rejected[0].Error)
+	assert.Len(t, pErr.FailedBulks, 1)
+	assert.Equal(t, []OpentsdbMetric{m[2]}, pErr.FailedBulks[0].Metrics)
+	assert.NotNil(t, pErr.FailedBulks[0].Err)
+}
+
+func TestPushErrorMessage(t *testing.T) {
+	e := PushError{
+		Rejected: []RejectedPoint{
+			{Error: "reason2"},
+			{Error: "reason1"},
+			{Error: "reason2"},
+		},
+		FailedBulks: []FailedBulk{{}},
+	}
+	assert.Equal(t, "3 points rejected by Opentsdb [reason1: 1, reason2: 2], 1 bulks failed", e.Error())
+}
+
+func TestPushGzip(t *testing.T) {
+	var tcs = []struct {
+		tcID   string
+		inGzip bool
+	}{
+		{"plain", false},
+		{"gzip", true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			pushed := []OpentsdbMetric{}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body io.Reader = r.Body
+				if tc.inGzip {
+					assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+					gz, err := gzip.NewReader(r.Body)
+					assert.Nil(t, err)
+					body = gz
+				} else {
+					assert.Empty(t, r.Header.Get("Content-Encoding"))
+				}
+				cur := []OpentsdbMetric{}
+				assert.Nil(t, json.NewDecoder(body).Decode(&cur))
+				pushed = append(pushed, cur...)
+				io.WriteString(w, "{ \"failed\":0, \"success\":1 }")
+			}))
+			defer ts.Close()
+
+			o, err := NewOpentsdb(ExporterConf{OpentsdbURL: ts.URL, BulkSize: 1, PushGzip: tc.inGzip})
+			assert.Nil(t, err)
+			m := []OpentsdbMetric{
+				{Metric: "m1", Timestamp: 42, Value: 1.5, Tags: map[string]string{"k": "v"}},
+				{Metric: "m2", Timestamp: 43, Value: 2.5, Tags: map[string]string{"k": "v"}},
+			}
+			assert.Nil(t, o.Push(context.TODO(), m))
+			assert.Equal(t, m, pushed)
+		})
+	}
+}
+
+func TestAppendValue(t *testing.T) {
+	var tcs = []struct {
+		tcID      string
+		inValue   float64
+		inInteger bool
+		exp       string
+	}{
+		{"float", 1.3, false, "1.3"},
+		{"integralAsFloat", 2, false, "2.0"},
+		{"largeAsFloat", 1e21, false, "1e+21"},
+		{"integralAsInteger", 2, true, "2"},
+		{"largeCounterAsInteger", 123456789012345, true, "123456789012345"},
+		{"negativeAsInteger", -3, true, "-3"},
+		{"floatAsInteger", 1.3, true, "1.3"},
+		{"outOfRangeAsInteger", 1e21, true, "1e+21"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.exp, string(appendValue(nil, tc.inValue, tc.inInteger)))
+			assert.Equal(t, "v="+tc.exp, string(appendValue([]byte("v="), tc.inValue, tc.inInteger)))
+		})
+	}
+}
+
+func TestDoPushValueEncoding(t *testing.T) {
+	var tcs = []struct {
+		tcID      string
+		inInteger bool
+		exp       string
+	}{
+		{"float", false, `[{"metric":"m1","timestamp":42,"value":1.23456789012345e+14,"tags":null}]`},
+		{"integer", true, `[{"metric":"m1","timestamp":42,"value":123456789012345,"tags":null}]`},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			body := ""
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				body = string(b)
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			o, err := NewOpentsdb(ExporterConf{OpentsdbURL: ts.URL, FloatValues: !tc.inInteger})
+			assert.Nil(t, err)
+			assert.Nil(t, o.doPush(context.TODO(), []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 123456789012345}}))
+			assert.Equal(t, tc.exp, body)
+		})
+	}
+}
+
+// referencePoint is the encoding/json representation of a metric sent to Opentsdb, used as a reference
+type referencePoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp uint64            `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+func marshalReference(m []OpentsdbMetric, integer bool) ([]byte, error) {
+	points := make([]referencePoint, len(m))
+	for i, curMetric := range m {
+		points[i] = referencePoint{
+			Metric:    curMetric.Metric,
+			Timestamp: curMetric.Timestamp,
+			Value:     json.Number(appendValue(nil, curMetric.Value, integer)),
+			Tags:      curMetric.Tags,
+		}
+	}
+	return json.Marshal(points)
+}
+
+func TestAppendJSONPoints(t *testing.T) {
+	tags := map[string]string{"k2": "v2", "k1": "v1", "quote\"": "back\\slash", "ctrl": "a\nb\tc\x01", "html": "<&>", "utf8": "été\u2028", "invalid": "a\xffb"}
+	var tcs = []struct {
+		tcID    string
+		inM     []OpentsdbMetric
+		integer bool
+	}{
+		{"empty", []OpentsdbMetric{}, false},
+		{"nilTags", []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1}}, false},
+		{"emptyTags", []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1.5, Tags: map[string]string{}}}, false},
+		{"tags", []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1.5, Tags: tags}, {Metric: "m\"2", Timestamp: 43, Value: -3, Tags: tags}}, false},
+		{"sharedEncodedTags", []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1, Tags: tags, encoded: encodeTags(tags)}, {Metric: "m1", Timestamp: 43, Value: 2, Tags: tags, encoded: encodeTags(tags)}}, true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			exp, err := marshalReference(tc.inM, tc.integer)
+			assert.Nil(t, err)
+			assert.Equal(t, string(exp), string(appendJSONPoints(nil, tc.inM, tc.integer)))
+		})
+	}
+}
+
+// benchBulks splits the converted metrics of the benchmark matrix into bulks
+func benchBulks(b *testing.B) [][]OpentsdbMetric {
+	m, err := collectResult(Prometheus{}, buildBenchMatrix(), QueryConf{MetricName: "bench"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	bulks := [][]OpentsdbMetric{}
+	for i := 0; i < len(m); i += int(defaultBulkSize) {
+		bulks = append(bulks, m[i:i+int(defaultBulkSize)])
+	}
+	return bulks
+}
+
+func BenchmarkEncodeJSONPoints(b *testing.B) {
+	bulks := benchBulks(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, curBulk := range bulks {
+			buf := bulkBufferPool.Get().(*[]byte)
+			*buf = appendJSONPoints((*buf)[:0], curBulk, false)
+			bulkBufferPool.Put(buf)
+		}
+	}
+}
+
+// BenchmarkEncodeJSONMarshal is the encoding/json reference of BenchmarkEncodeJSONPoints
+func BenchmarkEncodeJSONMarshal(b *testing.B) {
+	bulks := benchBulks(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, curBulk := range bulks {
+			if _, err := marshalReference(curBulk, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestPushStream(t *testing.T) {
+	mutex := sync.Mutex{}
+	received := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := []OpentsdbMetric{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&m))
+		assert.True(t, len(m) <= 2)
+		mutex.Lock()
+		received += len(m)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	o, err := NewOpentsdb(ExporterConf{OpentsdbURL: ts.URL, BulkSize: 2, ThreadCount: 2})
+	assert.Nil(t, err)
+	bulks := make(chan []OpentsdbMetric)
+	go func() {
+		defer close(bulks)
+		for i := 0; i < 5; i++ {
+			bulks <- []OpentsdbMetric{{Metric: "m1", Timestamp: uint64(i), Value: 1}, {Metric: "m1", Timestamp: uint64(i), Value: 2}, {Metric: "m1", Timestamp: uint64(i), Value: 3}}
+		}
+	}()
+	assert.Nil(t, o.PushStream(context.TODO(), bulks))
+	assert.Equal(t, 15, received)
+}
@@ -3,6 +3,10 @@ package internal
 import (
 	"context"
 	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	promC "github.com/prometheus/client_golang/api"
@@ -11,15 +15,76 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	defaultMaxPointsPerQuery uint   = 11000
+	defaultQueryThreadCount  uint   = 1
+	defaultTenantHeader      string = "X-Scope-OrgID"
+	defaultTenantTag         string = "tenant"
+	defaultMaxTags           uint   = 8
+)
+
 // Prometheus is a Prometheus connector
 type Prometheus struct {
-	api promHttpC.API
+	api              promHttpC.API
+	maxPoints        uint
+	queryThreadCount uint
+	tenantHeader     string
+	tenantTag        string
+	precision        string
+	maxTags          uint
+	bulkSize         uint
+}
+
+// queryWindow is a step-aligned sub-range of a query
+type queryWindow struct {
+	start time.Time
+	end   time.Time
 }
 
 // NewPrometheus instanciates a Prometheus connector
 func NewPrometheus(c ExporterConf) (Prometheus, error) {
-	p := Prometheus{}
-	promConf := promC.Config{Address: c.PrometheusURL}
+	p := Prometheus{
+		maxPoints:        c.MaxPointsPerQuery,
+		queryThreadCount: c.QueryThreadCount,
+		tenantHeader:     c.TenantHeader,
+		tenantTag:        c.TenantTag,
+		precision:        c.TimestampPrecision,
+		maxTags:          c.MaxTags,
+		bulkSize:         c.BulkSize,
+	}
+	if c.MaxPointsPerQuery == 0 {
+		logrus.Infof("Default max points per query will be used: %v", defaultMaxPointsPerQuery)
+		p.maxPoints = defaultMaxPointsPerQuery
+	}
+	if c.QueryThreadCount == 0 {
+		logrus.Infof("Default query thread count will be used: %v", defaultQueryThreadCount)
+		p.queryThreadCount = defaultQueryThreadCount
+	}
+	if c.BulkSize == 0 {
+		p.bulkSize = defaultBulkSize
+	}
+	if c.MaxTags == 0 {
+		logrus.Infof("Default max tags will be used: %v", defaultMaxTags)
+		p.maxTags = defaultMaxTags
+	}
+	if c.TenantHeader == "" {
+		p.tenantHeader = defaultTenantHeader
+	}
+	if c.TenantTag == "" {
+		p.tenantTag = defaultTenantTag
+	}
+	switch c.TimestampPrecision {
+	case "":
+		p.precision = secondsPrecision
+	case secondsPrecision, millisecondsPrecision:
+	default:
+		return p, fmt.Errorf("unsupported timestamp precision: %v", c.TimestampPrecision)
+	}
+	rt, err := newRoundTripper(c.PrometheusClient, p.queryThreadCount)
+	if err != nil {
+		return p, fmt.Errorf("error while initializing Prometheus http client: %v", err)
+	}
+	promConf := promC.Config{Address: c.PrometheusURL, RoundTripper: contextHeadersRoundTripper{next: rt}}
 	promClient, err := promC.NewClient(promConf)
 	if err != nil {
 		return p, fmt.Errorf("error while initializing Prometheus http client API: %v", err)
@@ -28,13 +93,304 @@ func NewPrometheus(c ExporterConf) (Prometheus, error) {
 	return p, nil
 }
 
-// Query executes the query
-func (p Prometheus) Query(ctx context.Context, c QueryConf) ([]OpentsdbMetric, error) {
-	v, _, err := p.doQuery(ctx, c)
+// QueryStream executes the query : a range query (the date range is split into several Prometheus queries if needed)
+// or an instant query. The metrics are sent to out, in bulks of at most BulkSize metrics, as soon as they are
+// converted : the whole result is never held in memory. out is not closed.
+// The warnings returned by Prometheus (partial data) are handled according to the warnings policy of the query,
+// they are returned unless they are ignored.
+// The warnings of a sub-query are checked before its metrics are sent : with the fail warnings policy,
+// the query stops at the first sub-query returning warnings. It returns the count of sent metrics
+func (p Prometheus) QueryStream(ctx context.Context, c QueryConf, out chan<- []OpentsdbMetric) (int, []string, error) {
+	c.TimestampPrecision = p.TimestampPrecision(c)
+	if err := checkTimestampPrecision(c.Step, c.TimestampPrecision); err != nil {
+		return 0, nil, err
+	}
+	sc, err := newSeriesConverter(c)
+	if err != nil {
+		return 0, nil, err
+	}
+	ctx = withHeaders(ctx, p.queryHeaders(c))
+	e := newBulkEmitter(ctx, out, p.bulkSize)
+
+	var warnings promC.Warnings
+	if c.Type == instantQueryType {
+		warnings, err = p.instantQuery(ctx, c, func(v promCommon.Value) error {
+			pointsReadCounter.WithLabelValues(c.Name).Add(float64(countSamples(v)))
+			return p.streamResult(v, c, sc, nil, e.add)
+		})
+	} else {
+		lastTimestamps := make(map[promCommon.Fingerprint]promCommon.Time)
+		warnings, err = p.splitQuery(ctx, c, func(v promCommon.Value) error {
+			pointsReadCounter.WithLabelValues(c.Name).Add(float64(countSamples(v)))
+			return p.streamResult(v, c, sc, lastTimestamps, e.add)
+		})
+	}
+	if err == nil {
+		err = e.flush()
+	}
+	if c.WarningsPolicy == ignoreWarningsPolicy {
+		warnings = nil
+	}
+	if err != nil {
+		queriesCounter.WithLabelValues(c.Name, failureQueryStatus).Inc()
+		return e.count, warnings, fmt.Errorf("error while executing query: %v", err)
+	}
+	queriesCounter.WithLabelValues(c.Name, successQueryStatus).Inc()
+	return e.count, warnings, nil
+}
+
+// bulkEmitter groups metrics into bulks sent to a channel
+type bulkEmitter struct {
+	ctx   context.Context
+	out   chan<- []OpentsdbMetric
+	size  int
+	bulk  []OpentsdbMetric
+	count int
+}
+
+func newBulkEmitter(ctx context.Context, out chan<- []OpentsdbMetric, bulkSize uint) *bulkEmitter {
+	if bulkSize == 0 {
+		bulkSize = defaultBulkSize
+	}
+	return &bulkEmitter{ctx: ctx, out: out, size: int(bulkSize)}
+}
+
+func (e *bulkEmitter) add(m OpentsdbMetric) error {
+	if e.bulk == nil {
+		e.bulk = make([]OpentsdbMetric, 0, e.size)
+	}
+	e.bulk = append(e.bulk, m)
+	if len(e.bulk) < e.size {
+		return nil
+	}
+	return e.flush()
+}
+
+// flush sends the current bulk, the bulk belongs to the receiver once sent
+func (e *bulkEmitter) flush() error {
+	if len(e.bulk) == 0 {
+		return nil
+	}
+	select {
+	case e.out <- e.bulk:
+	case <-e.ctx.Done():
+		return e.ctx.Err()
+	}
+	e.count += len(e.bulk)
+	e.bulk = nil
+	return nil
+}
+
+// checkWarnings applies the warnings policy of a query : warnings are logged (warn, default),
+// turned into an error (fail) or ignored (ignore)
+func checkWarnings(c QueryConf, warnings promC.Warnings) error {
+	if len(warnings) == 0 {
+		return nil
+	}
+	switch c.WarningsPolicy {
+	case ignoreWarningsPolicy:
+		logrus.Debugf("query '%v', %v Prometheus warnings ignored", c.Name, len(warnings))
+	case failWarningsPolicy:
+		return fmt.Errorf("Prometheus returned %v warnings (partial data): %v", len(warnings), strings.Join(warnings, "; "))
+	default:
+		for _, w := range warnings {
+			logrus.Warnf("query '%v' (%v to %v), Prometheus warning: %v", c.Name, c.Start, c.End, w)
+		}
+	}
+	return nil
+}
+
+// TimestampPrecision resolves the timestamp precision of a query : its precision or the exporter precision
+func (p Prometheus) TimestampPrecision(c QueryConf) string {
+	switch {
+	case c.TimestampPrecision != "":
+		return c.TimestampPrecision
+	case p.precision != "":
+		return p.precision
+	}
+	return secondsPrecision
+}
+
+// queryHeaders computes the HTTP headers of a query : its headers and its tenant header
+func (p Prometheus) queryHeaders(c QueryConf) map[string]string {
+	if c.Tenant == "" {
+		return c.Headers
+	}
+	h := make(map[string]string, len(c.Headers)+1)
+	for k, v := range c.Headers {
+		h[k] = v
+	}
+	tenantHeader := p.tenantHeader
+	if tenantHeader == "" {
+		tenantHeader = defaultTenantHeader
+	}
+	h[tenantHeader] = c.Tenant
+	return h
+}
+
+// splitQuery executes a range query, split into several step-aligned sub-queries if needed,
+// the results of the sub-queries are handled in the order of the date range
+func (p Prometheus) splitQuery(ctx context.Context, c QueryConf, handle func(v promCommon.Value) error) (promC.Warnings, error) {
+	step, err := time.ParseDuration(c.Step)
 	if err != nil {
-		return nil, fmt.Errorf("error while executing query: %v", err)
+		return nil, fmt.Errorf("error while parsing step (%v): %v", c.Step, err)
+	}
+	windows := p.splitRange(c.Start, c.End, step)
+	if len(windows) > 1 {
+		logrus.Debugf("query split into %v sub-queries", len(windows))
+	}
+
+	return p.runQueries(ctx, len(windows), func(ctx context.Context, i int) (promCommon.Value, promC.Warnings, error) {
+		subConf := c
+		subConf.Start = windows[i].start
+		subConf.End = windows[i].end
+		logrus.Debugf("sub-query %v, %v to %v", i, subConf.Start, subConf.End)
+		start := time.Now()
+		v, w, err := p.doQuery(ctx, subConf)
+		queryDuration.WithLabelValues(c.Name).Observe(time.Since(start).Seconds())
+		if err != nil && len(windows) > 1 {
+			err = fmt.Errorf("error on sub-query %v (%v to %v): %v", i, subConf.Start, subConf.End, err)
+		}
+		return v, w, err
+	}, func(i int, v promCommon.Value, w promC.Warnings) error {
+		subConf := c
+		subConf.Start = windows[i].start
+		subConf.End = windows[i].end
+		if err := checkWarnings(subConf, w); err != nil {
+			return err
+		}
+		return handle(v)
+	})
+}
+
+// runQueries executes n queries with queryThreadCount goroutines, the results are handled in the order of the queries
+// as soon as possible : at most queryThreadCount results are held in memory. The first error stops the execution
+func (p Prometheus) runQueries(ctx context.Context, n int, query func(ctx context.Context, i int) (promCommon.Value, promC.Warnings, error),
+	handle func(i int, v promCommon.Value, w promC.Warnings) error) (promC.Warnings, error) {
+	type result struct {
+		value    promCommon.Value
+		warnings promC.Warnings
+		err      error
+	}
+	threadCount := p.queryThreadCount
+	if threadCount == 0 {
+		threadCount = defaultQueryThreadCount
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]chan result, n)
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	tokens := make(chan struct{}, threadCount) // results held in memory
+	tasks := make(chan int)
+	wg := sync.WaitGroup{}
+
+	// dispatcher : the tokens are taken in the order of the queries, so the next handled query always gets one
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(tasks)
+		for i := 0; i < n; i++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case tasks <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	wg.Add(int(threadCount))
+	for i := uint(0); i < threadCount; i++ {
+		go func() {
+			defer wg.Done()
+			for curTask := range tasks {
+				v, w, err := query(ctx, curTask)
+				results[curTask] <- result{value: v, warnings: w, err: err}
+			}
+		}()
+	}
+
+	var allWarnings promC.Warnings
+	var err error
+	for i := 0; i < n && err == nil; i++ {
+		var r result
+		select {
+		case r = <-results[i]:
+		case <-ctx.Done():
+			err = ctx.Err()
+			continue
+		}
+		allWarnings = append(allWarnings, r.warnings...)
+		if err = r.err; err == nil {
+			err = handle(i, r.value, r.warnings)
+		}
+		<-tokens
+	}
+	cancel()
+	wg.Wait()
+	return allWarnings, err
+}
+
+// instantQuery executes an instant query at each step between start and end, or at end if no step is provided,
+// the results are handled in the order of the evaluation times
+func (p Prometheus) instantQuery(ctx context.Context, c QueryConf, handle func(v promCommon.Value) error) (promC.Warnings, error) {
+	times := []time.Time{c.End}
+	if c.Step != "" {
+		step, err := time.ParseDuration(c.Step)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing step (%v): %v", c.Step, err)
+		}
+		if step <= 0 {
+			return nil, fmt.Errorf("step must be positive (%v)", c.Step)
+		}
+		times = []time.Time{}
+		for t := c.Start; !t.After(c.End); t = t.Add(step) {
+			times = append(times, t)
+		}
 	}
-	return p.convertResult(v, c)
+	logrus.Debugf("instant query evaluated %v times", len(times))
+
+	return p.runQueries(ctx, len(times), func(ctx context.Context, i int) (promCommon.Value, promC.Warnings, error) {
+		start := time.Now()
+		v, w, err := p.api.Query(ctx, c.Query, times[i])
+		queryDuration.WithLabelValues(c.Name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			err = fmt.Errorf("error on instant query at %v: %v", times[i], err)
+		}
+		return v, w, err
+	}, func(i int, v promCommon.Value, w promC.Warnings) error {
+		if err := checkWarnings(c, w); err != nil {
+			return err
+		}
+		return handle(v)
+	})
+}
+
+// splitRange splits [start, end] into step-aligned windows holding at most maxPoints points each
+func (p Prometheus) splitRange(start time.Time, end time.Time, step time.Duration) []queryWindow {
+	maxPoints := p.maxPoints
+	if maxPoints == 0 {
+		maxPoints = defaultMaxPointsPerQuery
+	}
+	if step <= 0 || end.Before(start) {
+		return []queryWindow{{start: start, end: end}}
+	}
+	windowSpan := step * time.Duration(maxPoints-1)
+	windows := []queryWindow{}
+	for curStart := start; !curStart.After(end); curStart = curStart.Add(windowSpan + step) {
+		curEnd := curStart.Add(windowSpan)
+		if curEnd.After(end) {
+			curEnd = end
+		}
+		windows = append(windows, queryWindow{start: curStart, end: curEnd})
+	}
+	return windows
 }
 
 func (p Prometheus) doQuery(ctx context.Context, c QueryConf) (promCommon.Value, promC.Warnings, error) {
@@ -52,36 +408,260 @@ func (p Prometheus) doQuery(ctx context.Context, c QueryConf) (promCommon.Value,
 	return p.api.QueryRange(ctx, c.Query, ra)
 }
 
-func (p Prometheus) convertResult(v promCommon.Value, c QueryConf) ([]OpentsdbMetric, error) {
-	if v.Type() == promCommon.ValMatrix {
-		return p.convertMatrix(v.(promCommon.Matrix), c)
+// streamResult converts a Prometheus result, each metric is passed to emit.
+// If lastTimestamps is provided, the samples of a matrix that are not after the last emitted sample
+// of their series are skipped (sub-queries boundaries)
+func (p Prometheus) streamResult(v promCommon.Value, c QueryConf, sc seriesConverter, lastTimestamps map[promCommon.Fingerprint]promCommon.Time, emit func(OpentsdbMetric) error) error {
+	if v == nil {
+		return nil
+	}
+	switch v.Type() {
+	case promCommon.ValMatrix:
+		return p.convertMatrix(v.(promCommon.Matrix), c, sc, lastTimestamps, emit)
+	case promCommon.ValVector:
+		return p.convertVector(v.(promCommon.Vector), c, sc, emit)
+	case promCommon.ValScalar:
+		return p.convertScalar(v.(*promCommon.Scalar), c, sc, emit)
+	}
+	return fmt.Errorf("unsupported prometheus result type: %v", v.Type())
+}
+
+// seriesConverter holds the compiled settings of a query used to convert its series
+type seriesConverter struct {
+	namer metricNamer
+	rules []relabelRule
+}
+
+func newSeriesConverter(c QueryConf) (seriesConverter, error) {
+	sc := seriesConverter{}
+	var err error
+	if sc.namer, err = newMetricNamer(c.MetricName); err != nil {
+		return sc, err
+	}
+	if sc.rules, err = newRelabelRules(c.RelabelConfigs); err != nil {
+		return sc, err
+	}
+	return sc, nil
+}
+
+// convertSeries relabels a series and computes its metric name and its tags,
+// it returns false if the series has been dropped by the relabeling rules
+func (p Prometheus) convertSeries(m promCommon.Metric, c QueryConf, sc seriesConverter) (string, map[string]string, bool, error) {
+	m, keep := relabel(m, sc.rules)
+	if !keep {
+		return "", nil, false, nil
+	}
+	name, err := sc.namer.name(m)
+	if err != nil {
+		return "", nil, false, err
+	}
+	tags, keep, err := p.limitTags(p.convertTags(m, c), c)
+	if err != nil || !keep {
+		return "", nil, false, err
+	}
+	return name, tags, true, nil
+}
+
+// limitTags applies the max tags strategy of the query to the tags of a series (Opentsdb rejects the datapoints
+// with too many tags), it returns false if the series has to be dropped
+func (p Prometheus) limitTags(tags map[string]string, c QueryConf) (map[string]string, bool, error) {
+	maxTags := p.maxTags
+	if maxTags == 0 {
+		maxTags = defaultMaxTags
+	}
+	if uint(len(tags)) <= maxTags {
+		return tags, true, nil
+	}
+	switch c.MaxTagsStrategy {
+	case failMaxTagsStrategy:
+		return nil, false, fmt.Errorf("series %v has %v tags (max %v)", tags, len(tags), maxTags)
+	case priorityMaxTagsStrategy:
+		kept := make(map[string]string, maxTags)
+		for _, curTag := range c.TagsPriority {
+			if uint(len(kept)) == maxTags {
+				break
+			}
+			if v, found := tags[curTag]; found {
+				kept[curTag] = v
+			}
+		}
+		return kept, true, nil
+	}
+	logrus.Warnf("query '%v', series %v dropped: %v tags (max %v)", c.Name, tags, len(tags), maxTags)
+	return nil, false, nil
+}
+
+func (p Prometheus) convertVector(v promCommon.Vector, c QueryConf, sc seriesConverter, emit func(OpentsdbMetric) error) error {
+	logrus.Debugf("%v measures from Prometheus", len(v))
+	for _, curSample := range v {
+		value, keep, err := convertValue(curSample.Value, c)
+		if err != nil {
+			return fmt.Errorf("error on series %v at %v: %v", curSample.Metric, curSample.Timestamp, err)
+		}
+		if !keep {
+			continue
+		}
+		name, tags, keep, err := p.convertSeries(curSample.Metric, c, sc)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+		err = emit(OpentsdbMetric{
+			Metric:    name,
+			Timestamp: convertTimestamp(curSample.Timestamp, c),
+			Value:     value,
+			Tags:      tags,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p Prometheus) convertScalar(s *promCommon.Scalar, c QueryConf, sc seriesConverter, emit func(OpentsdbMetric) error) error {
+	value, keep, err := convertValue(s.Value, c)
+	if err != nil {
+		return fmt.Errorf("error on scalar at %v: %v", s.Timestamp, err)
+	}
+	if !keep {
+		return nil
+	}
+	name, tags, keep, err := p.convertSeries(promCommon.Metric{}, c, sc)
+	if err != nil || !keep {
+		return err
 	}
-	return []OpentsdbMetric{}, fmt.Errorf("unsupported prometheus result type: %v", v.Type())
+	return emit(OpentsdbMetric{
+		Metric:    name,
+		Timestamp: convertTimestamp(s.Timestamp, c),
+		Value:     value,
+		Tags:      tags,
+	})
 }
 
-func (p Prometheus) convertMatrix(m promCommon.Matrix, c QueryConf) ([]OpentsdbMetric, error) {
+func (p Prometheus) convertMatrix(m promCommon.Matrix, c QueryConf, sc seriesConverter, lastTimestamps map[promCommon.Fingerprint]promCommon.Time, emit func(OpentsdbMetric) error) error {
 	i := 0
 	for _, curSS := range m {
 		i += len(curSS.Values)
 	}
-	out := make([]OpentsdbMetric, i, i)
 	logrus.Debugf("%v measures from Prometheus", i)
 
-	i = 0
+	dropped := 0
+	droppedSeries := 0
 	for _, curSS := range m {
-		tags := p.convertTags(curSS.Metric, c)
+		name, tags, keep, err := p.convertSeries(curSS.Metric, c, sc)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			droppedSeries++
+			continue
+		}
+		encoded := encodeTags(tags) // tags are encoded once for all the points of the series
+		var fp promCommon.Fingerprint
+		var last promCommon.Time
+		var found bool
+		if lastTimestamps != nil {
+			fp = curSS.Metric.Fingerprint()
+			last, found = lastTimestamps[fp]
+		}
 		for _, pt := range curSS.Values {
+			if found && !pt.Timestamp.After(last) { // sub-queries boundary duplicate
+				continue
+			}
+			if lastTimestamps != nil {
+				last, found = pt.Timestamp, true
+				lastTimestamps[fp] = last
+			}
+			value, keep, err := convertValue(pt.Value, c)
+			if err != nil {
+				return fmt.Errorf("error on series %v at %v: %v", curSS.Metric, pt.Timestamp, err)
+			}
+			if !keep {
+				dropped++
+				continue
+			}
 			outCur := OpentsdbMetric{}
-			outCur.Timestamp = uint64(pt.Timestamp) / 1000
-			outCur.Value = float32(pt.Value)
+			outCur.Timestamp = convertTimestamp(pt.Timestamp, c)
+			outCur.Value = value
 			outCur.Tags = tags
-			outCur.Metric = c.MetricName
-			out[i] = outCur
-			i++
+			outCur.encoded = encoded
+			outCur.Metric = name
+			if err := emit(outCur); err != nil {
+				return err
+			}
 		}
 	}
+	if droppedSeries > 0 {
+		logrus.Debugf("%v series dropped (relabeling rules or max tags)", droppedSeries)
+	}
+	if dropped > 0 {
+		logrus.Debugf("%v non-finite measures dropped", dropped)
+	}
+	return nil
+}
 
-	return out, nil
+// metricNamer builds the metric name of the series of a query : either the static metric name
+// or a template (prom.{{.__name__}}) evaluated with the labels of each series
+type metricNamer struct {
+	static string
+	tmpl   *template.Template
+}
+
+func newMetricNamer(metricName string) (metricNamer, error) {
+	if !strings.Contains(metricName, "{{") {
+		return metricNamer{static: metricName}, nil
+	}
+	tmpl, err := template.New("metricName").Option("missingkey=zero").Parse(metricName)
+	if err != nil {
+		return metricNamer{}, fmt.Errorf("error while parsing metric name template (%v): %v", metricName, err)
+	}
+	return metricNamer{tmpl: tmpl}, nil
+}
+
+// name returns the metric name of a series, templated names are normalized
+func (n metricNamer) name(m promCommon.Metric) (string, error) {
+	if n.tmpl == nil {
+		return n.static, nil
+	}
+	labels := make(map[string]string, len(m))
+	for k, v := range m {
+		labels[string(k)] = string(v)
+	}
+	buf := strings.Builder{}
+	if err := n.tmpl.Execute(&buf, labels); err != nil {
+		return "", fmt.Errorf("error while building metric name of series %v: %v", m, err)
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("empty metric name for series %v", m)
+	}
+	return Prometheus{}.normalize(buf.String()), nil
+}
+
+// convertTimestamp converts a Prometheus timestamp (milliseconds) to the timestamp precision of the query
+func convertTimestamp(t promCommon.Time, c QueryConf) uint64 {
+	if c.TimestampPrecision == millisecondsPrecision {
+		return uint64(t)
+	}
+	return uint64(t) / 1000
+}
+
+// convertValue applies the non-finite values policy of the query (NaN and infinite values are rejected by Opentsdb),
+// it returns whether the value has to be kept
+func convertValue(v promCommon.SampleValue, c QueryConf) (float64, bool, error) {
+	f := float64(v)
+	if !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return f, true, nil
+	}
+	switch c.NonFinitePolicy {
+	case replaceNonFinitePolicy:
+		return c.NonFiniteReplacement, true, nil
+	case failNonFinitePolicy:
+		return 0, false, fmt.Errorf("non-finite value: %v", f)
+	}
+	return 0, false, nil
 }
 
 func (p Prometheus) keepTag(k string, c QueryConf) bool {
@@ -110,6 +690,13 @@ func (p Prometheus) convertTags(ss promCommon.Metric, c QueryConf) map[string]st
 	for cK, cV := range c.AddTags { // add
 		tags[p.normalize(cK)] = p.normalize(cV)
 	}
+	if c.Tenant != "" { // tenant
+		tenantTag := p.tenantTag
+		if tenantTag == "" {
+			tenantTag = defaultTenantTag
+		}
+		tags[p.normalize(tenantTag)] = p.normalize(c.Tenant)
+	}
 	return tags
 }
 
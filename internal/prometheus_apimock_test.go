@@ -17,15 +17,23 @@ func NewPromApiMock() PromApiMock {
 	m.SetQueryRangeOutput(nil, nil, nil)
 	f := func(ctx context.Context, query string, r promHttpC.Range) {}
 	m.SetQueryRangeCheckFunc(f)
+	m.SetQueryOutput(nil, nil, nil)
+	m.SetQueryCheckFunc(func(ctx context.Context, query string, ts time.Time) {})
 	return m
 }
 
 type PromApiMock struct {
 	// QueryRange
-	queryRangeOutValue    model.Value
-	queryRangeOutWarnings api.Warnings
-	queryRangeOutError    error
-	queryRangeCheckFunc   func(ctx context.Context, query string, r promHttpC.Range)
+	queryRangeOutValue     model.Value
+	queryRangeOutWarnings  api.Warnings
+	queryRangeOutError     error
+	queryRangeCheckFunc    func(ctx context.Context, query string, r promHttpC.Range)
+	queryRangeWarningsFunc func(r promHttpC.Range) api.Warnings
+	// Query
+	queryOutValue    model.Value
+	queryOutWarnings api.Warnings
+	queryOutError    error
+	queryCheckFunc   func(ctx context.Context, query string, ts time.Time)
 }
 
 func (m *PromApiMock) SetQueryRangeOutput(v model.Value, w api.Warnings, err error) {
@@ -38,11 +46,29 @@ func (m *PromApiMock) SetQueryRangeCheckFunc(f func(ctx context.Context, query s
 	m.queryRangeCheckFunc = f
 }
 
+// SetQueryRangeWarningsFunc overrides the warnings of the output, depending on the range
+func (m *PromApiMock) SetQueryRangeWarningsFunc(f func(r promHttpC.Range) api.Warnings) {
+	m.queryRangeWarningsFunc = f
+}
+
 func (m PromApiMock) QueryRange(ctx context.Context, query string, r promHttpC.Range) (model.Value, api.Warnings, error) {
 	m.queryRangeCheckFunc(ctx, query, r)
+	if m.queryRangeWarningsFunc != nil {
+		return m.queryRangeOutValue, m.queryRangeWarningsFunc(r), m.queryRangeOutError
+	}
 	return m.queryRangeOutValue, m.queryRangeOutWarnings, m.queryRangeOutError
 }
 
+func (m *PromApiMock) SetQueryOutput(v model.Value, w api.Warnings, err error) {
+	m.queryOutValue = v
+	m.queryOutWarnings = w
+	m.queryOutError = err
+}
+
+func (m *PromApiMock) SetQueryCheckFunc(f func(ctx context.Context, query string, ts time.Time)) {
+	m.queryCheckFunc = f
+}
+
 func (m PromApiMock) Alerts(ctx context.Context) (promHttpC.AlertsResult, error) {
 	return promHttpC.AlertsResult{}, nil
 }
@@ -76,7 +102,8 @@ func (m PromApiMock) LabelValues(ctx context.Context, label string) (model.Label
 }
 
 func (m PromApiMock) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
-	return nil, nil, nil
+	m.queryCheckFunc(ctx, query, ts)
+	return m.queryOutValue, m.queryOutWarnings, m.queryOutError
 }
 
 func (m PromApiMock) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
@@ -3,9 +3,14 @@ package internal
 import (
 	"context"
 	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
+	promC "github.com/prometheus/client_golang/api"
 	promHttpC "github.com/prometheus/client_golang/api/prometheus/v1"
 	promCommon "github.com/prometheus/common/model"
 	"github.com/stretchr/testify/assert"
@@ -34,6 +39,43 @@ func buildSampleStream(m promCommon.Metric, v []promCommon.SamplePair) promCommo
 	}
 }
 
+// collectQuery executes a query with QueryStream and collects the sent metrics
+func collectQuery(ctx context.Context, p Prometheus, c QueryConf) ([]OpentsdbMetric, []string, error) {
+	out := []OpentsdbMetric{}
+	bulks := make(chan []OpentsdbMetric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for curBulk := range bulks {
+			out = append(out, curBulk...)
+		}
+	}()
+	_, warnings, err := p.QueryStream(ctx, c, bulks)
+	close(bulks)
+	<-done
+	if err != nil {
+		return nil, warnings, err
+	}
+	return out, warnings, nil
+}
+
+// collectResult converts a Prometheus result with streamResult and collects the emitted metrics
+func collectResult(p Prometheus, v promCommon.Value, c QueryConf) ([]OpentsdbMetric, error) {
+	sc, err := newSeriesConverter(c)
+	if err != nil {
+		return nil, err
+	}
+	out := []OpentsdbMetric{}
+	err = p.streamResult(v, c, sc, nil, func(m OpentsdbMetric) error {
+		out = append(out, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func getReferenceMatrix() promCommon.Matrix {
 	cat1Tags := map[promCommon.LabelName]promCommon.LabelValue{
 		promCommon.LabelName("k1"): promCommon.LabelValue("v1"),
@@ -52,7 +94,7 @@ func getReferenceMatrix() promCommon.Matrix {
 	)
 }
 
-func checkOutputMetric(t *testing.T, m OpentsdbMetric, n string, ts uint64, v float32, ta map[string]string) {
+func checkOutputMetric(t *testing.T, m OpentsdbMetric, n string, ts uint64, v float64, ta map[string]string) {
 	assert.Equal(t, m.Metric, n)
 	assert.Equal(t, m.Timestamp, ts)
 	assert.Equal(t, m.Value, v)
@@ -64,7 +106,7 @@ func checkOutputMetric(t *testing.T, m OpentsdbMetric, n string, ts uint64, v fl
 
 func TestConvertResult(t *testing.T) {
 	c := QueryConf{MetricName: "blabla"}
-	o, err := Prometheus{}.convertResult(getReferenceMatrix(), c)
+	o, err := collectResult(Prometheus{}, getReferenceMatrix(), c)
 	assert.Nil(t, err)
 	assert.Len(t, o, 2)
 	expTags := map[string]string{"k1": "v1", "k2": "v2"}
@@ -83,7 +125,7 @@ func (UnsupportedResult) Type() promCommon.ValueType {
 }
 
 func TestUnsupportedResult(t *testing.T) {
-	_, err := Prometheus{}.convertResult(UnsupportedResult{}, QueryConf{})
+	_, err := collectResult(Prometheus{}, UnsupportedResult{}, QueryConf{})
 	assert.NotNil(t, err)
 }
 
@@ -155,7 +197,7 @@ func TestQueryNominal(t *testing.T) {
 	m := getReferenceMatrix()
 	api.SetQueryRangeOutput(m, nil, nil)
 
-	o, err := Prometheus{api: api}.Query(ctx, conf)
+	o, _, err := collectQuery(ctx, Prometheus{api: api}, conf)
 	assert.Nil(t, err)
 	assert.Len(t, o, 2)
 	expTags := map[string]string{"k1": "v1", "k2": "v2"}
@@ -177,7 +219,7 @@ func TestQueryErrorOnQuerying(t *testing.T) {
 	api := NewPromApiMock()
 	api.SetQueryRangeOutput(nil, nil, fmt.Errorf("a"))
 
-	_, err := Prometheus{api: api}.Query(ctx, conf)
+	_, _, err := collectQuery(ctx, Prometheus{api: api}, conf)
 	assert.NotNil(t, err)
 }
 
@@ -207,4 +249,624 @@ func TestConvertTag(t *testing.T) {
 		"d": "e",
 	}
 	assert.Equal(t, expTags, tags)
+
+	conf.Tenant = "my tenant"
+	tags = Prometheus{tenantTag: "org"}.convertTags(m, conf)
+	expTags["org"] = "my_tenant"
+	assert.Equal(t, expTags, tags)
+}
+
+func TestNewPrometheusDefaultValues(t *testing.T) {
+	p, err := NewPrometheus(ExporterConf{})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultMaxPointsPerQuery, p.maxPoints)
+	assert.Equal(t, defaultQueryThreadCount, p.queryThreadCount)
+}
+
+func TestSplitRange(t *testing.T) {
+	start := time.Date(2019, 7, 31, 17, 0, 0, 0, time.UTC)
+	var tcs = []struct {
+		tcID       string
+		inEnd      time.Time
+		inMaxPts   uint
+		expWindows []queryWindow
+	}{
+		{"single", start.Add(2 * time.Minute), 5, []queryWindow{
+			{start, start.Add(2 * time.Minute)},
+		}},
+		{"exact", start.Add(4 * time.Minute), 5, []queryWindow{
+			{start, start.Add(4 * time.Minute)},
+		}},
+		{"split", start.Add(11 * time.Minute), 5, []queryWindow{
+			{start, start.Add(4 * time.Minute)},
+			{start.Add(5 * time.Minute), start.Add(9 * time.Minute)},
+			{start.Add(10 * time.Minute), start.Add(11 * time.Minute)},
+		}},
+		{"unaligned", start.Add(5*time.Minute + 30*time.Second), 5, []queryWindow{
+			{start, start.Add(4 * time.Minute)},
+			{start.Add(5 * time.Minute), start.Add(5*time.Minute + 30*time.Second)},
+		}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			p := Prometheus{maxPoints: tc.inMaxPts}
+			assert.Equal(t, tc.expWindows, p.splitRange(start, tc.inEnd, time.Minute))
+		})
+	}
+}
+
+func TestStreamResultDeduplication(t *testing.T) {
+	m1 := buildMetric(map[string]string{"k": "1"})
+	m2 := buildMetric(map[string]string{"k": "2"})
+	ss1 := buildSampleStream(m1, []promCommon.SamplePair{buildSimplePair(1000, 1), buildSimplePair(2000, 2)})
+	ss2 := buildSampleStream(m1, []promCommon.SamplePair{buildSimplePair(2000, 2), buildSimplePair(3000, 3)})
+	ss3 := buildSampleStream(m2, []promCommon.SamplePair{buildSimplePair(3000, 4)})
+	v := []promCommon.Value{
+		promCommon.Matrix{&ss1},
+		promCommon.Matrix{&ss2, &ss3},
+	}
+	c := QueryConf{MetricName: "blabla"}
+	sc, err := newSeriesConverter(c)
+	assert.Nil(t, err)
+	lastTimestamps := make(map[promCommon.Fingerprint]promCommon.Time)
+	o := []OpentsdbMetric{}
+	emit := func(m OpentsdbMetric) error {
+		o = append(o, m)
+		return nil
+	}
+	for _, curValue := range v {
+		assert.Nil(t, Prometheus{}.streamResult(curValue, c, sc, lastTimestamps, emit))
+	}
+	assert.Len(t, o, 4)
+	checkOutputMetric(t, o[0], "blabla", 1, 1, map[string]string{"k": "1"})
+	checkOutputMetric(t, o[1], "blabla", 2, 2, map[string]string{"k": "1"})
+	checkOutputMetric(t, o[2], "blabla", 3, 3, map[string]string{"k": "1"})
+	checkOutputMetric(t, o[3], "blabla", 3, 4, map[string]string{"k": "2"})
+
+	assert.NotNil(t, Prometheus{}.streamResult(UnsupportedResult{}, c, sc, lastTimestamps, emit))
+}
+
+func TestQuerySplit(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2019, 7, 31, 17, 0, 0, 0, time.UTC)
+	conf := QueryConf{
+		MetricName: "blabla",
+		Step:       "1m",
+		Query:      "myQuery",
+		Start:      start,
+		End:        start.Add(11 * time.Minute),
+	}
+	api := NewPromApiMock()
+	mutex := sync.Mutex{}
+	starts := []int64{}
+	api.SetQueryRangeCheckFunc(func(ctx context.Context, query string, r promHttpC.Range) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		starts = append(starts, r.Start.Unix())
+	})
+	api.SetQueryRangeOutput(getReferenceMatrix(), nil, nil)
+
+	o, _, err := collectQuery(ctx, Prometheus{api: api, maxPoints: 5, queryThreadCount: 2}, conf)
+	assert.Nil(t, err)
+	assert.Len(t, o, 2) // same samples for each sub-query : deduplicated
+	assert.ElementsMatch(t, []int64{start.Unix(), start.Add(5 * time.Minute).Unix(), start.Add(10 * time.Minute).Unix()}, starts)
+}
+
+func TestQuerySplitError(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2019, 7, 31, 17, 0, 0, 0, time.UTC)
+	conf := QueryConf{
+		MetricName: "blabla",
+		Step:       "1m",
+		Query:      "myQuery",
+		Start:      start,
+		End:        start.Add(11 * time.Minute),
+	}
+	api := NewPromApiMock()
+	api.SetQueryRangeOutput(nil, nil, fmt.Errorf("a"))
+
+	_, _, err := collectQuery(ctx, Prometheus{api: api, maxPoints: 5, queryThreadCount: 2}, conf)
+	assert.NotNil(t, err)
+}
+
+func TestQueryTenants(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "exporterValue", r.Header.Get("X-Exporter"))
+		assert.Equal(t, "queryValue", r.Header.Get("X-Query"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"org":"%v"},"values":[[1564592490,"2"]]}]}}`, r.Header.Get("X-Org"))
+	}))
+	defer ts.Close()
+
+	c := ExporterConf{
+		PrometheusURL:    ts.URL,
+		PrometheusClient: HTTPClientConf{Headers: map[string]string{"X-Exporter": "exporterValue"}},
+		TenantHeader:     "X-Org",
+	}
+	p, err := NewPrometheus(c)
+	assert.Nil(t, err)
+	start := time.Unix(1564592490, 0)
+	for _, tenant := range []string{"t1", "t2"} {
+		q := QueryConf{MetricName: "m", Step: "30s", Start: start, End: start, Tenant: tenant, Headers: map[string]string{"X-Query": "queryValue"}}
+		o, _, err := collectQuery(context.Background(), p, q)
+		assert.Nil(t, err)
+		assert.Len(t, o, 1)
+		assert.Equal(t, map[string]string{"org": tenant, "tenant": tenant}, o[0].Tags)
+	}
+}
+
+func TestQueryHeaders(t *testing.T) {
+	p := Prometheus{tenantHeader: "X-Scope-OrgID"}
+	assert.Nil(t, p.queryHeaders(QueryConf{}))
+	assert.Equal(t, map[string]string{"a": "b"}, p.queryHeaders(QueryConf{Headers: map[string]string{"a": "b"}}))
+	assert.Equal(t, map[string]string{"a": "b", "X-Scope-OrgID": "t"}, p.queryHeaders(QueryConf{Tenant: "t", Headers: map[string]string{"a": "b"}}))
+}
+
+func TestConvertVector(t *testing.T) {
+	v := promCommon.Vector{
+		{Metric: buildMetric(map[string]string{"k": "1"}), Value: 1.5, Timestamp: 1346846400000},
+		{Metric: buildMetric(map[string]string{"k": "2"}), Value: 2.5, Timestamp: 1346846400000},
+	}
+	o, err := collectResult(Prometheus{}, v, QueryConf{MetricName: "blabla", AddTags: map[string]string{"a": "b"}})
+	assert.Nil(t, err)
+	assert.Len(t, o, 2)
+	checkOutputMetric(t, o[0], "blabla", 1346846400, 1.5, map[string]string{"k": "1", "a": "b"})
+	checkOutputMetric(t, o[1], "blabla", 1346846400, 2.5, map[string]string{"k": "2", "a": "b"})
+}
+
+func TestConvertScalar(t *testing.T) {
+	s := &promCommon.Scalar{Value: 42, Timestamp: 1346846400000}
+	o, err := collectResult(Prometheus{}, s, QueryConf{MetricName: "blabla", AddTags: map[string]string{"a": "b"}})
+	assert.Nil(t, err)
+	assert.Len(t, o, 1)
+	checkOutputMetric(t, o[0], "blabla", 1346846400, 42, map[string]string{"a": "b"})
+}
+
+func TestInstantQuery(t *testing.T) {
+	start := time.Date(2019, 7, 31, 0, 0, 0, 0, time.UTC)
+	end := start.Add(48 * time.Hour)
+	var tcs = []struct {
+		tcID     string
+		inStep   string
+		expTimes []time.Time
+	}{
+		{"atEnd", "", []time.Time{end}},
+		{"eachStep", "24h", []time.Time{start, start.Add(24 * time.Hour), end}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			mutex := sync.Mutex{}
+			times := []time.Time{}
+			api := NewPromApiMock()
+			api.SetQueryCheckFunc(func(ctx context.Context, query string, ts time.Time) {
+				assert.Equal(t, "count(kube_pod_info)", query)
+				mutex.Lock()
+				defer mutex.Unlock()
+				times = append(times, ts)
+			})
+			api.SetQueryOutput(promCommon.Vector{{Metric: buildMetric(map[string]string{"k": "v"}), Value: 3, Timestamp: 1346846400000}}, nil, nil)
+			conf := QueryConf{
+				Type:       "instant",
+				MetricName: "blabla",
+				Query:      "count(kube_pod_info)",
+				Step:       tc.inStep,
+				Start:      start,
+				End:        end,
+			}
+
+			o, _, err := collectQuery(context.Background(), Prometheus{api: api, queryThreadCount: 2}, conf)
+			assert.Nil(t, err)
+			assert.Len(t, o, len(tc.expTimes))
+			assert.ElementsMatch(t, tc.expTimes, times)
+		})
+	}
+}
+
+func TestInstantQueryErrors(t *testing.T) {
+	api := NewPromApiMock()
+	api.SetQueryOutput(nil, nil, fmt.Errorf("a"))
+	conf := QueryConf{Type: "instant", MetricName: "blabla", Query: "q", End: time.Now()}
+	_, _, err := collectQuery(context.Background(), Prometheus{api: api}, conf)
+	assert.NotNil(t, err)
+
+	conf.Step = "blabla"
+	_, _, err = collectQuery(context.Background(), Prometheus{api: NewPromApiMock()}, conf)
+	assert.NotNil(t, err)
+}
+
+func TestQueryWarnings(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inPolicy    string
+		expSuccess  bool
+		expWarnings []string
+	}{
+		{"default", "", true, []string{"w1", "w2"}},
+		{"warn", "warn", true, []string{"w1", "w2"}},
+		{"ignore", "ignore", true, nil},
+		{"fail", "fail", false, []string{"w1", "w2"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			api := NewPromApiMock()
+			api.SetQueryOutput(promCommon.Vector{{Metric: buildMetric(map[string]string{"k": "v"}), Value: 3, Timestamp: 1346846400000}}, []string{"w1", "w2"}, nil)
+			conf := QueryConf{Type: "instant", MetricName: "blabla", Query: "q", End: time.Now(), WarningsPolicy: tc.inPolicy}
+			o, w, err := collectQuery(context.Background(), Prometheus{api: api}, conf)
+			assert.Equal(t, tc.expWarnings, w)
+			if tc.expSuccess {
+				assert.Nil(t, err)
+				assert.Len(t, o, 1)
+			} else {
+				assert.NotNil(t, err)
+				assert.Nil(t, o)
+			}
+		})
+	}
+}
+
+func TestConvertResultPrecision(t *testing.T) {
+	m := promCommon.Matrix{
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{}),
+			Values: []promCommon.SamplePair{buildSimplePair(134684640000000, 123456789012345)},
+		},
+	}
+	o, err := collectResult(Prometheus{}, m, QueryConf{MetricName: "blabla"})
+	assert.Nil(t, err)
+	assert.Len(t, o, 1)
+	assert.Equal(t, float64(123456789012345), o[0].Value)
+}
+
+func TestConvertResultNonFinite(t *testing.T) {
+	m := promCommon.Matrix{
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{}),
+			Values: []promCommon.SamplePair{
+				buildSimplePair(134684640000000, 1),
+				buildSimplePair(134684640100000, math.NaN()),
+				buildSimplePair(134684640200000, math.Inf(1)),
+				buildSimplePair(134684640300000, math.Inf(-1)),
+			},
+		},
+	}
+	var tcs = []struct {
+		tcID          string
+		inPolicy      string
+		inReplacement float64
+		expSuccess    bool
+		expValues     []float64
+	}{
+		{"default", "", 0, true, []float64{1}},
+		{"drop", "drop", 0, true, []float64{1}},
+		{"replace", "replace", -1, true, []float64{1, -1, -1, -1}},
+		{"fail", "fail", 0, false, nil},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			c := QueryConf{MetricName: "blabla", NonFinitePolicy: tc.inPolicy, NonFiniteReplacement: tc.inReplacement}
+			o, err := collectResult(Prometheus{}, m, c)
+			if !tc.expSuccess {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			values := []float64{}
+			for _, curMetric := range o {
+				values = append(values, curMetric.Value)
+			}
+			assert.Equal(t, tc.expValues, values)
+		})
+	}
+}
+
+func TestConvertResultMilliseconds(t *testing.T) {
+	m := promCommon.Matrix{
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{}),
+			Values: []promCommon.SamplePair{buildSimplePair(1346846400000, 1), buildSimplePair(1346846400500, 2)},
+		},
+	}
+	o, err := collectResult(Prometheus{}, m, QueryConf{MetricName: "blabla", TimestampPrecision: "ms"})
+	assert.Nil(t, err)
+	assert.Len(t, o, 2)
+	checkOutputMetric(t, o[0], "blabla", 1346846400000, 1, map[string]string{})
+	checkOutputMetric(t, o[1], "blabla", 1346846400500, 2, map[string]string{})
+}
+
+func TestQueryTimestampPrecision(t *testing.T) {
+	var tcs = []struct {
+		tcID                string
+		inExporterPrecision string
+		inQueryPrecision    string
+		expPrecision        string
+		expSuccess          bool
+	}{
+		{"default", "", "", "s", false},
+		{"exporter", "ms", "", "ms", true},
+		{"query", "s", "ms", "ms", true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			p, err := NewPrometheus(ExporterConf{PrometheusURL: "http://localhost:9090", TimestampPrecision: tc.inExporterPrecision})
+			assert.Nil(t, err)
+			api := NewPromApiMock()
+			api.SetQueryRangeOutput(promCommon.Matrix{}, nil, nil)
+			p.api = api
+			conf := QueryConf{MetricName: "blabla", Query: "q", Step: "500ms", TimestampPrecision: tc.inQueryPrecision, Start: time.Now(), End: time.Now()}
+			assert.Equal(t, tc.expPrecision, p.TimestampPrecision(conf))
+			_, _, err = collectQuery(context.Background(), p, conf)
+			assert.Equal(t, tc.expSuccess, err == nil)
+		})
+	}
+}
+
+func TestNewPrometheusUnsupportedPrecision(t *testing.T) {
+	_, err := NewPrometheus(ExporterConf{PrometheusURL: "http://localhost:9090", TimestampPrecision: "us"})
+	assert.NotNil(t, err)
+}
+
+func TestConvertResultMetricNameTemplate(t *testing.T) {
+	m := promCommon.Matrix{
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{"__name__": "node_load1", "namespace": "ns 1"}),
+			Values: []promCommon.SamplePair{buildSimplePair(1346846400000, 1)},
+		},
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{"__name__": "node_load5"}),
+			Values: []promCommon.SamplePair{buildSimplePair(1346846400000, 2)},
+		},
+	}
+	var tcs = []struct {
+		tcID         string
+		inMetricName string
+		expSuccess   bool
+		expNames     []string
+	}{
+		{"static", "blabla", true, []string{"blabla", "blabla"}},
+		{"name", "prom.{{.__name__}}", true, []string{"prom.node_load1", "prom.node_load5"}},
+		{"normalizedAndMissingLabel", "k8s.{{.namespace}}.{{.__name__}}", true, []string{"k8s.ns_1.node_load1", "k8s..node_load5"}},
+		{"empty", "{{.blabla}}", false, nil},
+		{"unparsable", "{{.blabla", false, nil},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			o, err := collectResult(Prometheus{}, m, QueryConf{MetricName: tc.inMetricName})
+			if !tc.expSuccess {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			names := []string{}
+			for _, curMetric := range o {
+				names = append(names, curMetric.Metric)
+			}
+			assert.Equal(t, tc.expNames, names)
+		})
+	}
+}
+
+func TestConvertResultRelabel(t *testing.T) {
+	m := promCommon.Matrix{
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{"__name__": "node_load1", "instance": "host1:9100"}),
+			Values: []promCommon.SamplePair{buildSimplePair(1346846400000, 1)},
+		},
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{"__name__": "go_goroutines", "instance": "host1:9100"}),
+			Values: []promCommon.SamplePair{buildSimplePair(1346846400000, 2)},
+		},
+	}
+	c := QueryConf{
+		MetricName: "prom.{{.__name__}}",
+		RemoveTags: []string{"__name__"},
+		RelabelConfigs: []RelabelConfig{
+			{SourceLabels: []string{"__name__"}, Regex: "node_.*", Action: "keep"},
+			{SourceLabels: []string{"instance"}, Regex: "(.*):.*", TargetLabel: "host"},
+			{Regex: "instance", Action: "labeldrop"},
+		},
+	}
+	o, err := collectResult(Prometheus{}, m, c)
+	assert.Nil(t, err)
+	assert.Len(t, o, 1)
+	checkOutputMetric(t, o[0], "prom.node_load1", 1346846400, 1, map[string]string{"host": "host1"})
+}
+
+func TestConvertResultMaxTags(t *testing.T) {
+	m := promCommon.Matrix{
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}),
+			Values: []promCommon.SamplePair{buildSimplePair(1346846400000, 1)},
+		},
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{"a": "1"}),
+			Values: []promCommon.SamplePair{buildSimplePair(1346846400000, 2)},
+		},
+	}
+	var tcs = []struct {
+		tcID         string
+		inStrategy   string
+		inPriority   []string
+		expSuccess   bool
+		expCount     int
+		expFirstTags map[string]string
+	}{
+		{"default", "", nil, true, 1, map[string]string{"a": "1"}},
+		{"drop", "drop", nil, true, 1, map[string]string{"a": "1"}},
+		{"fail", "fail", nil, false, 0, nil},
+		{"priority", "priority", []string{"z", "d", "b", "a"}, true, 2, map[string]string{"d": "4", "b": "2"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			c := QueryConf{MetricName: "blabla", MaxTagsStrategy: tc.inStrategy, TagsPriority: tc.inPriority}
+			o, err := collectResult(Prometheus{maxTags: 2}, m, c)
+			if !tc.expSuccess {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Len(t, o, tc.expCount)
+			assert.Equal(t, tc.expFirstTags, o[0].Tags)
+		})
+	}
+}
+
+func TestQueryStreamBulks(t *testing.T) {
+	api := NewPromApiMock()
+	api.SetQueryRangeOutput(promCommon.Matrix{
+		&promCommon.SampleStream{
+			Metric: buildMetric(map[string]string{"k": "v"}),
+			Values: []promCommon.SamplePair{
+				buildSimplePair(1000, 1), buildSimplePair(2000, 2), buildSimplePair(3000, 3),
+				buildSimplePair(4000, 4), buildSimplePair(5000, 5),
+			},
+		},
+	}, nil, nil)
+	conf := QueryConf{MetricName: "blabla", Query: "q", Step: "1s", Start: time.Unix(1, 0), End: time.Unix(5, 0)}
+
+	bulks := make(chan []OpentsdbMetric)
+	sizes := []int{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for b := range bulks {
+			sizes = append(sizes, len(b))
+		}
+	}()
+	count, _, err := Prometheus{api: api, bulkSize: 2}.QueryStream(context.Background(), conf, bulks)
+	close(bulks)
+	<-done
+	assert.Nil(t, err)
+	assert.Equal(t, 5, count)
+	assert.Equal(t, []int{2, 2, 1}, sizes)
+}
+
+func TestQueryStreamFailWarningsPolicy(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inPolicy   string
+		inWarnFrom int64 // sub-queries starting after this second return warnings
+		expSuccess bool
+		expCount   int
+	}{
+		{"warn", "warn", 4, true, 1},
+		{"failFirstSubQuery", "fail", 0, false, 0},
+		{"failLastSubQuery", "fail", 4, false, 1}, // the previous sub-queries are pushed
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			api := NewPromApiMock()
+			api.SetQueryRangeOutput(promCommon.Matrix{
+				&promCommon.SampleStream{
+					Metric: buildMetric(map[string]string{"k": "v"}),
+					Values: []promCommon.SamplePair{buildSimplePair(1000, 1)},
+				},
+			}, nil, nil)
+			api.SetQueryRangeWarningsFunc(func(r promHttpC.Range) promC.Warnings {
+				if r.Start.After(time.Unix(tc.inWarnFrom, 0)) {
+					return promC.Warnings{"partial data"}
+				}
+				return nil
+			})
+			conf := QueryConf{MetricName: "blabla", Query: "q", Step: "1s", Start: time.Unix(1, 0), End: time.Unix(5, 0), WarningsPolicy: tc.inPolicy}
+
+			bulks := make(chan []OpentsdbMetric)
+			received := 0
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for b := range bulks {
+					received += len(b)
+				}
+			}()
+			_, _, err := Prometheus{api: api, maxPoints: 2, bulkSize: 1}.QueryStream(context.Background(), conf, bulks)
+			close(bulks)
+			<-done
+			assert.Equal(t, tc.expSuccess, err == nil)
+			assert.Equal(t, tc.expCount, received)
+		})
+	}
+}
+
+func TestRunQueriesOrderedAndBounded(t *testing.T) {
+	mutex := sync.Mutex{}
+	held, maxHeld := 0, 0
+	handled := []int{}
+	query := func(ctx context.Context, i int) (promCommon.Value, promC.Warnings, error) {
+		time.Sleep(time.Duration((7*i)%5) * time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		held++
+		if held > maxHeld {
+			maxHeld = held
+		}
+		return nil, promC.Warnings{fmt.Sprintf("w%v", i)}, nil
+	}
+	handle := func(i int, v promCommon.Value, w promC.Warnings) error {
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		held--
+		handled = append(handled, i)
+		return nil
+	}
+	w, err := Prometheus{queryThreadCount: 3}.runQueries(context.Background(), 10, query, handle)
+	assert.Nil(t, err)
+	assert.Len(t, w, 10)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, handled)
+	assert.True(t, maxHeld <= 3, "max held results: %v", maxHeld)
+}
+
+func TestRunQueriesStopsOnError(t *testing.T) {
+	handled := []int{}
+	query := func(ctx context.Context, i int) (promCommon.Value, promC.Warnings, error) {
+		if i == 2 {
+			return nil, nil, fmt.Errorf("a")
+		}
+		return nil, nil, nil
+	}
+	handle := func(i int, v promCommon.Value, w promC.Warnings) error {
+		handled = append(handled, i)
+		return nil
+	}
+	_, err := Prometheus{queryThreadCount: 2}.runQueries(context.Background(), 10, query, handle)
+	assert.NotNil(t, err)
+	assert.Equal(t, []int{0, 1}, handled)
+}
+
+// buildBenchMatrix builds a matrix of 1M points : 1000 series of 1000 points
+func buildBenchMatrix() promCommon.Matrix {
+	m := promCommon.Matrix{}
+	for i := 0; i < 1000; i++ {
+		ss := buildSampleStream(buildMetric(map[string]string{
+			"__name__": "node_cpu_seconds_total",
+			"instance": fmt.Sprintf("host%v:9100", i),
+			"job":      "node",
+			"cpu":      fmt.Sprintf("%v", i%8),
+			"mode":     "idle",
+		}), make([]promCommon.SamplePair, 0, 1000))
+		for j := 0; j < 1000; j++ {
+			ss.Values = append(ss.Values, buildSimplePair(uint64(1346846400000+j*15000), float64(j)+0.5))
+		}
+		m = append(m, &ss)
+	}
+	return m
+}
+
+func BenchmarkConvertMatrix(b *testing.B) {
+	m := buildBenchMatrix()
+	c := QueryConf{MetricName: "bench"}
+	sc, err := newSeriesConverter(c)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := Prometheus{}.streamResult(m, c, sc, map[promCommon.Fingerprint]promCommon.Time{}, func(m OpentsdbMetric) error {
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
 }
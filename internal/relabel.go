@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	promCommon "github.com/prometheus/common/model"
+)
+
+const (
+	replaceRelabelAction   = "replace"
+	keepRelabelAction      = "keep"
+	dropRelabelAction      = "drop"
+	labelDropRelabelAction = "labeldrop"
+	labelKeepRelabelAction = "labelkeep"
+	labelMapRelabelAction  = "labelmap"
+	hashModRelabelAction   = "hashmod"
+	lowercaseRelabelAction = "lowercase"
+
+	defaultRelabelSeparator   = ";"
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelReplacement = "$1"
+)
+
+// RelabelConfig modelize a relabeling rule, with the semantics of the Prometheus relabel_configs
+type RelabelConfig struct {
+	// Labels whose values are concatenated (with the separator) and matched against the regex
+	SourceLabels []string
+	// Separator of the concatenated values, ; if not provided
+	Separator string
+	// Regex matched against the concatenated values (anchored), (.*) if not provided
+	Regex string
+	// Modulus of the hash of the concatenated values (hashmod)
+	Modulus uint64
+	// Label written by the replace, hashmod and lowercase actions
+	TargetLabel string
+	// Replacement of the regex match (replace, labelmap), $1 if not provided
+	Replacement *string
+	// Action : replace (default), keep, drop, labeldrop, labelkeep, labelmap, hashmod or lowercase
+	Action string
+}
+
+// relabelRule is a relabeling rule whose regex has been compiled
+type relabelRule struct {
+	RelabelConfig
+	regex *regexp.Regexp
+}
+
+// newRelabelRules checks the relabeling rules and compiles their regexes
+func newRelabelRules(configs []RelabelConfig) ([]relabelRule, error) {
+	rules := make([]relabelRule, len(configs))
+	for i, curConf := range configs {
+		if curConf.Separator == "" {
+			curConf.Separator = defaultRelabelSeparator
+		}
+		if curConf.Regex == "" {
+			curConf.Regex = defaultRelabelRegex
+		}
+		if curConf.Replacement == nil {
+			r := defaultRelabelReplacement
+			curConf.Replacement = &r
+		}
+		if curConf.Action == "" {
+			curConf.Action = replaceRelabelAction
+		}
+		regex, err := regexp.Compile("^(?:" + curConf.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("error while compiling regex of relabeling rule %v (%v): %v", i, curConf.Regex, err)
+		}
+		switch curConf.Action {
+		case replaceRelabelAction, lowercaseRelabelAction:
+			if curConf.TargetLabel == "" {
+				return nil, fmt.Errorf("no target label provided for relabeling rule %v (%v)", i, curConf.Action)
+			}
+		case hashModRelabelAction:
+			if curConf.TargetLabel == "" {
+				return nil, fmt.Errorf("no target label provided for relabeling rule %v (%v)", i, curConf.Action)
+			}
+			if curConf.Modulus == 0 {
+				return nil, fmt.Errorf("no modulus provided for relabeling rule %v (%v)", i, curConf.Action)
+			}
+		case keepRelabelAction, dropRelabelAction, labelDropRelabelAction, labelKeepRelabelAction, labelMapRelabelAction:
+		default:
+			return nil, fmt.Errorf("unsupported action for relabeling rule %v: %v", i, curConf.Action)
+		}
+		rules[i] = relabelRule{RelabelConfig: curConf, regex: regex}
+	}
+	return rules, nil
+}
+
+// relabel applies the relabeling rules to the labels of a series, it returns false if the series has to be dropped
+func relabel(m promCommon.Metric, rules []relabelRule) (promCommon.Metric, bool) {
+	if len(rules) == 0 {
+		return m, true
+	}
+	labels := make(promCommon.Metric, len(m))
+	for k, v := range m {
+		labels[k] = v
+	}
+	for _, curRule := range rules {
+		values := make([]string, len(curRule.SourceLabels))
+		for i, curLabel := range curRule.SourceLabels {
+			values[i] = string(labels[promCommon.LabelName(curLabel)])
+		}
+		val := strings.Join(values, curRule.Separator)
+
+		switch curRule.Action {
+		case replaceRelabelAction:
+			indexes := curRule.regex.FindStringSubmatchIndex(val)
+			if indexes == nil {
+				break
+			}
+			target := promCommon.LabelName(curRule.regex.ExpandString(nil, curRule.TargetLabel, val, indexes))
+			if !target.IsValid() {
+				break
+			}
+			res := curRule.regex.ExpandString(nil, *curRule.Replacement, val, indexes)
+			if len(res) == 0 {
+				delete(labels, target)
+				break
+			}
+			labels[target] = promCommon.LabelValue(res)
+		case keepRelabelAction:
+			if !curRule.regex.MatchString(val) {
+				return nil, false
+			}
+		case dropRelabelAction:
+			if curRule.regex.MatchString(val) {
+				return nil, false
+			}
+		case hashModRelabelAction:
+			sum := md5.Sum([]byte(val))
+			mod := binary.BigEndian.Uint64(sum[8:]) % curRule.Modulus
+			labels[promCommon.LabelName(curRule.TargetLabel)] = promCommon.LabelValue(fmt.Sprintf("%d", mod))
+		case lowercaseRelabelAction:
+			labels[promCommon.LabelName(curRule.TargetLabel)] = promCommon.LabelValue(strings.ToLower(val))
+		case labelMapRelabelAction:
+			mapped := promCommon.Metric{}
+			for k, v := range labels {
+				if curRule.regex.MatchString(string(k)) {
+					mapped[promCommon.LabelName(curRule.regex.ReplaceAllString(string(k), *curRule.Replacement))] = v
+				}
+			}
+			for k, v := range mapped {
+				labels[k] = v
+			}
+		case labelDropRelabelAction:
+			for k := range labels {
+				if curRule.regex.MatchString(string(k)) {
+					delete(labels, k)
+				}
+			}
+		case labelKeepRelabelAction:
+			for k := range labels {
+				if !curRule.regex.MatchString(string(k)) {
+					delete(labels, k)
+				}
+			}
+		}
+	}
+	return labels, true
+}
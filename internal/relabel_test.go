@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestNewRelabelRules(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inConfig   RelabelConfig
+		expSuccess bool
+	}{
+		{"defaultReplace", RelabelConfig{SourceLabels: []string{"a"}, TargetLabel: "b"}, true},
+		{"replaceWithoutTarget", RelabelConfig{SourceLabels: []string{"a"}}, false},
+		{"hashmodWithoutModulus", RelabelConfig{Action: "hashmod", TargetLabel: "b"}, false},
+		{"unparsableRegex", RelabelConfig{Action: "keep", Regex: "("}, false},
+		{"unsupportedAction", RelabelConfig{Action: "blabla"}, false},
+		{"labeldrop", RelabelConfig{Action: "labeldrop", Regex: "a.*"}, true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			_, err := newRelabelRules([]RelabelConfig{tc.inConfig})
+			assert.Equal(t, tc.expSuccess, err == nil)
+		})
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	in := map[string]string{"__name__": "node_load1", "instance": "host1:9100", "job": "Node", "__meta_zone": "eu"}
+	var tcs = []struct {
+		tcID      string
+		inConfigs []RelabelConfig
+		expKeep   bool
+		expLabels map[string]string
+	}{
+		{
+			"replace",
+			[]RelabelConfig{{SourceLabels: []string{"instance"}, Regex: "(.*):.*", TargetLabel: "host"}},
+			true,
+			map[string]string{"__name__": "node_load1", "instance": "host1:9100", "job": "Node", "__meta_zone": "eu", "host": "host1"},
+		},
+		{
+			"replaceSeveralSources",
+			[]RelabelConfig{{SourceLabels: []string{"job", "instance"}, Separator: "/", TargetLabel: "id", Replacement: strPtr("id-$1")}},
+			true,
+			map[string]string{"__name__": "node_load1", "instance": "host1:9100", "job": "Node", "__meta_zone": "eu", "id": "id-Node/host1:9100"},
+		},
+		{
+			"replaceEmptyDeletes",
+			[]RelabelConfig{{SourceLabels: []string{"blabla"}, TargetLabel: "job"}},
+			true,
+			map[string]string{"__name__": "node_load1", "instance": "host1:9100", "__meta_zone": "eu"},
+		},
+		{
+			"replaceNoMatch",
+			[]RelabelConfig{{SourceLabels: []string{"job"}, Regex: "blabla", TargetLabel: "job2"}},
+			true,
+			in,
+		},
+		{
+			"keepMatching",
+			[]RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: "node_.*", Action: "keep"}},
+			true,
+			in,
+		},
+		{
+			"keepNotMatching",
+			[]RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: "keep"}},
+			false,
+			nil,
+		},
+		{
+			"dropMatching",
+			[]RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: "node_.*", Action: "drop"}},
+			false,
+			nil,
+		},
+		{
+			"labeldrop",
+			[]RelabelConfig{{Regex: "__meta_.*|job", Action: "labeldrop"}},
+			true,
+			map[string]string{"__name__": "node_load1", "instance": "host1:9100"},
+		},
+		{
+			"labelkeep",
+			[]RelabelConfig{{Regex: "__name__|job", Action: "labelkeep"}},
+			true,
+			map[string]string{"__name__": "node_load1", "job": "Node"},
+		},
+		{
+			"labelmap",
+			[]RelabelConfig{{Regex: "__meta_(.*)", Action: "labelmap"}},
+			true,
+			map[string]string{"__name__": "node_load1", "instance": "host1:9100", "job": "Node", "__meta_zone": "eu", "zone": "eu"},
+		},
+		{
+			"hashmod",
+			[]RelabelConfig{{SourceLabels: []string{"instance"}, Modulus: 1, TargetLabel: "shard", Action: "hashmod"}},
+			true,
+			map[string]string{"__name__": "node_load1", "instance": "host1:9100", "job": "Node", "__meta_zone": "eu", "shard": "0"},
+		},
+		{
+			"lowercase",
+			[]RelabelConfig{{SourceLabels: []string{"job"}, TargetLabel: "job", Action: "lowercase"}},
+			true,
+			map[string]string{"__name__": "node_load1", "instance": "host1:9100", "job": "node", "__meta_zone": "eu"},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			rules, err := newRelabelRules(tc.inConfigs)
+			assert.Nil(t, err)
+			m := buildMetric(in)
+			out, keep := relabel(m, rules)
+			assert.Equal(t, tc.expKeep, keep)
+			assert.Equal(t, buildMetric(in), m) // input unchanged
+			if tc.expKeep {
+				assert.Equal(t, buildMetric(tc.expLabels), out)
+			}
+		})
+	}
+}
+
+func TestRelabelHashmodSpread(t *testing.T) {
+	rules, err := newRelabelRules([]RelabelConfig{{SourceLabels: []string{"instance"}, Modulus: 8, TargetLabel: "shard", Action: "hashmod"}})
+	assert.Nil(t, err)
+	a, _ := relabel(buildMetric(map[string]string{"instance": "host1"}), rules)
+	b, _ := relabel(buildMetric(map[string]string{"instance": "host1"}), rules)
+	assert.Equal(t, a["shard"], b["shard"]) // stable
+	assert.Contains(t, []string{"0", "1", "2", "3", "4", "5", "6", "7"}, string(a["shard"]))
+}
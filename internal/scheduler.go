@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	queryConfScheduleKey = "Schedule"
+	queryConfWindowKey   = "Window"
+)
+
+// schedule computes the next execution time of a query
+type schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// intervalSchedule triggers executions at fixed intervals, aligned on the interval
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Truncate(s.interval).Add(s.interval)
+}
+
+// parseSchedule parses a schedule : either a duration (1h, 30m, ...) or a standard cron expression (0 * * * *)
+func parseSchedule(s string) (schedule, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("schedule interval must be positive (%v)", s)
+		}
+		return intervalSchedule{interval: d}, nil
+	}
+	sc, err := cron.ParseStandard(s)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing schedule (%v): %v", s, err)
+	}
+	if sc.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule never triggers (%v)", s)
+	}
+	return sc, nil
+}
+
+// scheduledQuery is a query executed periodically on the previous full window
+type scheduledQuery struct {
+	conf     QueryConf
+	schedule schedule
+	window   time.Duration
+}
+
+// timeRange computes the previous full window relative to t
+func (s scheduledQuery) timeRange(t time.Time) (time.Time, time.Time) {
+	end := t.Truncate(s.window)
+	return end.Add(-s.window), end
+}
+
+// Scheduler executes queries periodically
+type Scheduler struct {
+	queries []scheduledQuery
+	run     func(ctx context.Context, c QueryConf) error
+	now     func() time.Time
+}
+
+// NewScheduler instanciates a scheduler, each query must define a schedule and a window
+func NewScheduler(confs []QueryConf, run func(ctx context.Context, c QueryConf) error) (Scheduler, error) {
+	s := Scheduler{run: run, now: time.Now}
+	for _, curConf := range confs {
+		if err := checkNotEmptyString(curConf.Schedule, queryConfScheduleKey, queryConfDesc); err != nil {
+			return s, fmt.Errorf("query '%v': %v", curConf.Name, err)
+		}
+		if err := checkNotEmptyString(curConf.Window, queryConfWindowKey, queryConfDesc); err != nil {
+			return s, fmt.Errorf("query '%v': %v", curConf.Name, err)
+		}
+		sc, err := parseSchedule(curConf.Schedule)
+		if err != nil {
+			return s, fmt.Errorf("query '%v': %v", curConf.Name, err)
+		}
+		w, err := time.ParseDuration(curConf.Window)
+		if err != nil {
+			return s, fmt.Errorf("query '%v': error while parsing window (%v): %v", curConf.Name, curConf.Window, err)
+		}
+		if w <= 0 {
+			return s, fmt.Errorf("query '%v': window must be positive (%v)", curConf.Name, curConf.Window)
+		}
+		s.queries = append(s.queries, scheduledQuery{conf: curConf, schedule: sc, window: w})
+	}
+	return s, nil
+}
+
+// Run executes the queries on schedule until the context is canceled, then waits for the running executions
+func (s Scheduler) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	wg.Add(len(s.queries))
+	for _, curQuery := range s.queries {
+		go func(q scheduledQuery) {
+			defer wg.Done()
+			s.loop(ctx, q)
+		}(curQuery)
+	}
+	wg.Wait()
+	logrus.Infof("Scheduler stopped")
+}
+
+func (s Scheduler) loop(ctx context.Context, q scheduledQuery) {
+	for {
+		next := q.schedule.Next(s.now())
+		if next.IsZero() {
+			logrus.Errorf("query '%v', no next execution, the query is no longer scheduled", q.conf.Name)
+			return
+		}
+		logrus.Debugf("query '%v', next execution: %v", q.conf.Name, next)
+		timer := time.NewTimer(next.Sub(s.now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		c := q.conf
+		c.Start, c.End = q.timeRange(next)
+		logrus.Infof("query '%v', executing from %v to %v", c.Name, c.Start, c.End)
+		if err := s.run(ctx, c); err != nil {
+			logrus.Errorf("query '%v' failed: %v", c.Name, err)
+			continue
+		}
+		logrus.Infof("query '%v' succeeded", c.Name)
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSchedule(t *testing.T) {
+	ref := time.Date(2019, 7, 31, 17, 12, 30, 0, time.UTC)
+	var tcs = []struct {
+		tcID    string
+		inSched string
+		expOk   bool
+		expNext time.Time
+	}{
+		{"interval", "1h", true, time.Date(2019, 7, 31, 18, 0, 0, 0, time.UTC)},
+		{"intervalMinutes", "15m", true, time.Date(2019, 7, 31, 17, 15, 0, 0, time.UTC)},
+		{"cron", "5 * * * *", true, time.Date(2019, 7, 31, 18, 5, 0, 0, time.UTC)},
+		{"cronDescriptor", "@daily", true, time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC)},
+		{"negativeInterval", "-1h", false, time.Time{}},
+		{"unparsable", "blabla", false, time.Time{}},
+		{"neverTriggered", "0 0 30 2 *", false, time.Time{}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			s, err := parseSchedule(tc.inSched)
+			if tc.expOk {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expNext, s.Next(ref).UTC())
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestScheduledQueryTimeRange(t *testing.T) {
+	q := scheduledQuery{window: time.Hour}
+	start, end := q.timeRange(time.Date(2019, 7, 31, 17, 12, 30, 0, time.UTC))
+	assert.Equal(t, time.Date(2019, 7, 31, 16, 0, 0, 0, time.UTC), start.UTC())
+	assert.Equal(t, time.Date(2019, 7, 31, 17, 0, 0, 0, time.UTC), end.UTC())
+}
+
+func TestNewSchedulerErrors(t *testing.T) {
+	run := func(ctx context.Context, c QueryConf) error { return nil }
+	var tcs = []struct {
+		tcID   string
+		inConf QueryConf
+	}{
+		{"noSchedule", QueryConf{Window: "1h"}},
+		{"noWindow", QueryConf{Schedule: "1h"}},
+		{"unparsableSchedule", QueryConf{Schedule: "blabla", Window: "1h"}},
+		{"unparsableWindow", QueryConf{Schedule: "1h", Window: "blabla"}},
+		{"negativeWindow", QueryConf{Schedule: "1h", Window: "-1h"}},
+		{"neverTriggeredSchedule", QueryConf{Schedule: "0 0 30 2 *", Window: "1h"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			_, err := NewScheduler([]QueryConf{tc.inConf}, run)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestSchedulerRun(t *testing.T) {
+	mutex := sync.Mutex{}
+	executions := map[string][]QueryConf{}
+	run := func(ctx context.Context, c QueryConf) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		executions[c.Name] = append(executions[c.Name], c)
+		return nil
+	}
+	confs := []QueryConf{
+		{Name: "q1", Schedule: "50ms", Window: "50ms"},
+		{Name: "q2", Schedule: "100ms", Window: "100ms"},
+	}
+	s, err := NewScheduler(confs, run)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 320*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.True(t, len(executions["q1"]) >= 3)
+	assert.True(t, len(executions["q2"]) >= 2)
+	for _, cur := range executions["q1"] {
+		assert.Equal(t, 50*time.Millisecond, cur.End.Sub(cur.Start))
+	}
+}
+
+// exhaustedSchedule has no next execution
+type exhaustedSchedule struct{}
+
+func (s exhaustedSchedule) Next(t time.Time) time.Time {
+	return time.Time{}
+}
+
+func TestSchedulerRunExhaustedSchedule(t *testing.T) {
+	executions := 0
+	run := func(ctx context.Context, c QueryConf) error {
+		executions++
+		return nil
+	}
+	s := Scheduler{
+		queries: []scheduledQuery{{conf: QueryConf{Name: "q1"}, schedule: exhaustedSchedule{}, window: time.Hour}},
+		run:     run,
+		now:     time.Now,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(context.Background()) // the query loop stops, Run returns without cancellation
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "scheduler not stopped")
+	}
+	assert.Equal(t, 0, executions)
+}
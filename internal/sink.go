@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	opentsdbSinkType       string = "opentsdb"
+	opentsdbTelnetSinkType string = "opentsdb-telnet"
+	jsonSinkType           string = "json"
+
+	sinkConfDesc       = "sink configuration"
+	sinkConfAddressKey = "Address"
+)
+
+// Sink is an output backend for the metrics
+type Sink interface {
+	// Push stores metrics
+	Push(ctx context.Context, m []OpentsdbMetric) error
+	// PushStream stores the bulks of metrics received from a channel as they arrive,
+	// every bulk is consumed until the channel is closed (even on error)
+	PushStream(ctx context.Context, bulks <-chan []OpentsdbMetric) error
+	// Close releases the resources of the sink
+	Close() error
+}
+
+// SinkConf modelize a sink configuration
+type SinkConf struct {
+	// Type of the sink (opentsdb, opentsdb-telnet, json)
+	Type string
+	// URL of the backend (opentsdb), the exporter OpentsdbURL if not provided
+	URL string
+	// Address of the backend (opentsdb-telnet), host:port
+	Address string
+	// File where metrics are written (json), stdout if not provided
+	File string
+}
+
+// NewSink instanciates the sinks of an exporter configuration, a single Opentsdb sink is used if no sink is configured
+func NewSink(c ExporterConf) (Sink, error) {
+	if len(c.Sinks) == 0 {
+		c.Sinks = []SinkConf{{Type: opentsdbSinkType}}
+	}
+	sinks := multiSink{}
+	for i, curConf := range c.Sinks {
+		s, err := newSink(c, curConf)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("error while creating sink %v (%v): %v", i, curConf.Type, err)
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+// NewOpentsdbSinks instanciates the Opentsdb sinks (opentsdb and opentsdb-telnet) of an exporter configuration,
+// a single Opentsdb sink is used if no sink is configured. The other sinks are ignored : they don't write dead letters
+func NewOpentsdbSinks(c ExporterConf) ([]Sink, error) {
+	if len(c.Sinks) == 0 {
+		c.Sinks = []SinkConf{{Type: opentsdbSinkType}}
+	}
+	sinks := multiSink{}
+	for i, curConf := range c.Sinks {
+		if t := strings.ToLower(curConf.Type); t != opentsdbSinkType && t != opentsdbTelnetSinkType {
+			continue
+		}
+		s, err := newSink(c, curConf)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("error while creating sink %v (%v): %v", i, curConf.Type, err)
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no %v or %v sink in the %v", opentsdbSinkType, opentsdbTelnetSinkType, exporterConfDesc)
+	}
+	return sinks, nil
+}
+
+func newSink(c ExporterConf, s SinkConf) (Sink, error) {
+	switch strings.ToLower(s.Type) {
+	case opentsdbSinkType:
+		if s.URL != "" {
+			c.OpentsdbURL = s.URL
+		}
+		if err := checkNotEmptyString(c.OpentsdbURL, exporterConfOpentsdbUrlKey, exporterConfDesc); err != nil {
+			return nil, err
+		}
+		o, err := NewOpentsdb(c)
+		if err != nil {
+			return nil, err
+		}
+		return o, nil
+	case opentsdbTelnetSinkType:
+		if err := checkNotEmptyString(s.Address, sinkConfAddressKey, sinkConfDesc); err != nil {
+			return nil, err
+		}
+		t, err := NewOpentsdbTelnet(c, s.Address)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	case jsonSinkType:
+		if s.File == "" {
+			return NewJSONSink(os.Stdout), nil
+		}
+		f, err := os.OpenFile(s.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error while opening file '%v': %v", s.File, err)
+		}
+		return NewJSONSink(f), nil
+	}
+	return nil, fmt.Errorf("unsupported sink type: %v", s.Type)
+}
+
+// JSONSink prints metrics as json
+type JSONSink struct {
+	w io.Writer
+}
+
+// NewJSONSink instanciates a json sink, the writer is closed with the sink if it is closable (except stdout)
+func NewJSONSink(w io.Writer) JSONSink {
+	return JSONSink{w: w}
+}
+
+// Push prints metrics
+func (s JSONSink) Push(ctx context.Context, m []OpentsdbMetric) error {
+	j, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return fmt.Errorf("error while printing results: %v", err)
+	}
+	if _, err := fmt.Fprintf(s.w, "%v\n", string(j)); err != nil {
+		return fmt.Errorf("error while printing results: %v", err)
+	}
+	return nil
+}
+
+// PushStream prints the bulks of metrics as they arrive
+func (s JSONSink) PushStream(ctx context.Context, bulks <-chan []OpentsdbMetric) error {
+	var firstErr error
+	for m := range bulks {
+		if err := s.Push(ctx, m); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes the underlying writer
+func (s JSONSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok && s.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// multiSink pushes metrics to several sinks
+type multiSink []Sink
+
+func (s multiSink) Push(ctx context.Context, m []OpentsdbMetric) error {
+	errs := []string{}
+	for i, curSink := range s {
+		if err := curSink.Push(ctx, m); err != nil {
+			errs = append(errs, fmt.Sprintf("sink %v: %v", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error while pushing to sinks: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// PushStream forwards each bulk to every sink, the bulks are shared and must not be modified by the sinks
+func (s multiSink) PushStream(ctx context.Context, bulks <-chan []OpentsdbMetric) error {
+	errs := make([]error, len(s))
+	channels := make([]chan []OpentsdbMetric, len(s))
+	wg := sync.WaitGroup{}
+	wg.Add(len(s))
+	for i, curSink := range s {
+		channels[i] = make(chan []OpentsdbMetric)
+		go func(i int, curSink Sink) {
+			defer wg.Done()
+			errs[i] = curSink.PushStream(ctx, channels[i])
+		}(i, curSink)
+	}
+	for m := range bulks {
+		for _, curChannel := range channels {
+			curChannel <- m
+		}
+	}
+	for _, curChannel := range channels {
+		close(curChannel)
+	}
+	wg.Wait()
+
+	msgs := []string{}
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("sink %v: %v", i, err))
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("error while pushing to sinks: %v", strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+func (s multiSink) Close() error {
+	errs := []string{}
+	for i, curSink := range s {
+		if err := curSink.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("sink %v: %v", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error while closing sinks: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingSink struct {
+	pushCount  int
+	closeCount int
+}
+
+func (s *failingSink) Push(ctx context.Context, m []OpentsdbMetric) error {
+	s.pushCount++
+	return fmt.Errorf("push failure")
+}
+
+func (s *failingSink) PushStream(ctx context.Context, bulks <-chan []OpentsdbMetric) error {
+	for range bulks {
+		s.pushCount++
+	}
+	return fmt.Errorf("push failure")
+}
+
+func (s *failingSink) Close() error {
+	s.closeCount++
+	return fmt.Errorf("close failure")
+}
+
+func TestNewSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var tcs = []struct {
+		tcID    string
+		inConf  ExporterConf
+		expOk   bool
+		expType interface{}
+	}{
+		{"default", ExporterConf{OpentsdbURL: "http://127.0.0.1:4242"}, true, Opentsdb{}},
+		{"defaultNoUrl", ExporterConf{}, false, nil},
+		{"opentsdb", ExporterConf{Sinks: []SinkConf{{Type: "opentsdb", URL: "http://127.0.0.1:4242"}}}, true, Opentsdb{}},
+		{"opentsdbNoUrl", ExporterConf{Sinks: []SinkConf{{Type: "opentsdb"}}}, false, nil},
+		{"opentsdbTelnet", ExporterConf{Sinks: []SinkConf{{Type: "opentsdb-telnet", Address: "127.0.0.1:4242"}}}, true, OpentsdbTelnet{}},
+		{"opentsdbTelnetNoAddress", ExporterConf{Sinks: []SinkConf{{Type: "opentsdb-telnet"}}}, false, nil},
+		{"jsonStdout", ExporterConf{Sinks: []SinkConf{{Type: "json"}}}, true, JSONSink{}},
+		{"jsonFile", ExporterConf{Sinks: []SinkConf{{Type: "JSON", File: filepath.Join(dir, "out.json")}}}, true, JSONSink{}},
+		{"jsonWrongFile", ExporterConf{Sinks: []SinkConf{{Type: "json", File: filepath.Join(dir, "nonExisting", "out.json")}}}, false, nil},
+		{"multi", ExporterConf{OpentsdbURL: "http://127.0.0.1:4242", Sinks: []SinkConf{{Type: "opentsdb"}, {Type: "json"}}}, true, multiSink{}},
+		{"unsupported", ExporterConf{Sinks: []SinkConf{{Type: "blabla"}}}, false, nil},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			s, err := NewSink(tc.inConf)
+			if tc.expOk {
+				assert.Nil(t, err)
+				assert.IsType(t, tc.expType, s)
+				assert.Nil(t, s.Close())
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestNewOpentsdbSinks(t *testing.T) {
+	var tcs = []struct {
+		tcID   string
+		inConf ExporterConf
+		expNb  int
+	}{
+		{"default", ExporterConf{OpentsdbURL: "http://127.0.0.1:4242"}, 1},
+		{"defaultNoUrl", ExporterConf{}, 0},
+		{"sinks", ExporterConf{Sinks: []SinkConf{{Type: "opentsdb", URL: "http://127.0.0.1:4242"}, {Type: "json"}, {Type: "opentsdb", URL: "http://127.0.0.1:4243"}}}, 2},
+		{"sinkNoUrl", ExporterConf{Sinks: []SinkConf{{Type: "opentsdb"}}}, 0},
+		{"telnetSink", ExporterConf{Sinks: []SinkConf{{Type: "json"}, {Type: "opentsdb-telnet", Address: "127.0.0.1:4242"}}}, 1},
+		{"telnetSinkNoAddress", ExporterConf{Sinks: []SinkConf{{Type: "opentsdb", URL: "http://127.0.0.1:4242"}, {Type: "opentsdb-telnet"}}}, 0},
+		{"noOpentsdbSink", ExporterConf{Sinks: []SinkConf{{Type: "json"}}}, 0},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			s, err := NewOpentsdbSinks(tc.inConf)
+			assert.Equal(t, tc.expNb > 0, err == nil)
+			assert.Len(t, s, tc.expNb)
+		})
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	buf := bytes.Buffer{}
+	s := NewJSONSink(&buf)
+	m := []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1.5, Tags: map[string]string{"k": "v"}}}
+	assert.Nil(t, s.Push(context.TODO(), m))
+	out := []OpentsdbMetric{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &out))
+	assert.Equal(t, m, out)
+	assert.Nil(t, s.Close())
+}
+
+func TestMultiSink(t *testing.T) {
+	buf := bytes.Buffer{}
+	failing := &failingSink{}
+	s := multiSink{failing, NewJSONSink(&buf)}
+	m := []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1.5}}
+
+	assert.NotNil(t, s.Push(context.TODO(), m))
+	assert.Equal(t, 1, failing.pushCount)
+	assert.NotEmpty(t, buf.String()) // pushed even if the first sink failed
+
+	assert.NotNil(t, s.Close())
+	assert.Equal(t, 1, failing.closeCount)
+}
+
+func TestMultiSinkPushStream(t *testing.T) {
+	buf := bytes.Buffer{}
+	failing := &failingSink{}
+	s := multiSink{failing, NewJSONSink(&buf)}
+	bulks := make(chan []OpentsdbMetric)
+	go func() {
+		defer close(bulks)
+		bulks <- []OpentsdbMetric{{Metric: "m1", Timestamp: 42, Value: 1.5}}
+		bulks <- []OpentsdbMetric{{Metric: "m2", Timestamp: 43, Value: 2.5}}
+	}()
+
+	assert.NotNil(t, s.PushStream(context.TODO(), bulks))
+	assert.Equal(t, 2, failing.pushCount) // every bulk consumed even if the sink failed
+	assert.Contains(t, buf.String(), "m1")
+	assert.Contains(t, buf.String(), "m2")
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// StateStore stores, for each query, the end date of the last successful push (checkpoint)
+type StateStore struct {
+	path        string
+	mutex       *sync.Mutex
+	checkpoints map[string]time.Time
+}
+
+// NewStateStore instanciates a state store persisted in a json file, the file is loaded if it exists
+func NewStateStore(path string) (StateStore, error) {
+	s := StateStore{
+		path:        path,
+		mutex:       &sync.Mutex{},
+		checkpoints: make(map[string]time.Time),
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return s, nil
+	}
+	if err := loadJson(path, &s.checkpoints); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// Checkpoint returns the checkpoint of a query
+func (s StateStore) Checkpoint(query string) (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, found := s.checkpoints[query]
+	return t, found
+}
+
+// SetCheckpoint updates the checkpoint of a query and persists the state file
+func (s StateStore) SetCheckpoint(query string, t time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checkpoints[query] = t
+	return s.save()
+}
+
+func (s StateStore) save() error {
+	data, err := json.MarshalIndent(s.checkpoints, "", "\t")
+	if err != nil {
+		return fmt.Errorf("error while marshaling state: %v", err)
+	}
+	return writeFileAtomically(s.path, data)
+}
+
+// writeFileAtomically writes data to a temporary file then renames it so that the file is never partially written,
+// the file is readable by everyone (0644) like the files written by ioutil.WriteFile
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error while creating temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error while changing permissions of temporary file '%v': %v", tmp.Name(), err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error while writing temporary file '%v': %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error while closing temporary file '%v': %v", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error while writing file '%v': %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2o")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := NewStateStore(path)
+	assert.Nil(t, err)
+	_, found := s.Checkpoint("q1")
+	assert.False(t, found)
+
+	ts := time.Date(2019, 7, 31, 17, 0, 0, 0, time.UTC)
+	assert.Nil(t, s.SetCheckpoint("q1", ts))
+	cp, found := s.Checkpoint("q1")
+	assert.True(t, found)
+	assert.Equal(t, ts, cp)
+
+	reloaded, err := NewStateStore(path)
+	assert.Nil(t, err)
+	cp, found = reloaded.Checkpoint("q1")
+	assert.True(t, found)
+	assert.True(t, ts.Equal(cp))
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1) // no temporary file left
+}
+
+func TestStateStoreUnparsable(t *testing.T) {
+	_, err := NewStateStore("../testdata/confFiles/unparsable.json")
+	assert.NotNil(t, err)
+}
+
+func TestStateStoreWriteFailure(t *testing.T) {
+	s, err := NewStateStore("nonExistingDir/state.json")
+	assert.Nil(t, err)
+	assert.NotNil(t, s.SetCheckpoint("q1", time.Now()))
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseTime parses a date : RFC3339 (2019-07-31T00:00:00Z), epoch seconds (1564531200)
+// or an expression relative to now : now, today, yesterday, followed by offsets (-1h, +30m, -2d, -1w)
+// and roundings to the start of a unit (/d). An expression starting with an offset is relative to now (-24h)
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	if t, err := ParseAbsoluteTime(s); err == nil {
+		return t, nil
+	}
+
+	var t time.Time
+	expr := s
+	switch {
+	case strings.HasPrefix(expr, "now"):
+		t, expr = now, expr[len("now"):]
+	case strings.HasPrefix(expr, "today"):
+		t, expr = roundTime(now, 'd'), expr[len("today"):]
+	case strings.HasPrefix(expr, "yesterday"):
+		t, expr = roundTime(now, 'd').AddDate(0, 0, -1), expr[len("yesterday"):]
+	case strings.HasPrefix(expr, "-"), strings.HasPrefix(expr, "+"):
+		t = now
+	default:
+		return t, fmt.Errorf("unsupported date (%v): RFC3339, epoch seconds or relative expression (now-1h, now/d, yesterday, -24h) expected", s)
+	}
+
+	for expr != "" {
+		op := expr[0]
+		expr = expr[1:]
+		i := 0
+		for i < len(expr) && expr[i] >= '0' && expr[i] <= '9' {
+			i++
+		}
+		if i == len(expr) {
+			return t, fmt.Errorf("error while parsing date (%v): missing unit", s)
+		}
+		unit := expr[i]
+		switch op {
+		case '+', '-':
+			if i == 0 {
+				return t, fmt.Errorf("error while parsing date (%v): missing offset value", s)
+			}
+			n, err := strconv.Atoi(expr[:i])
+			if err != nil {
+				return t, fmt.Errorf("error while parsing date (%v): %v", s, err)
+			}
+			if op == '-' {
+				n = -n
+			}
+			if t, err = addTime(t, n, unit); err != nil {
+				return t, fmt.Errorf("error while parsing date (%v): %v", s, err)
+			}
+		case '/':
+			if i != 0 || !strings.ContainsRune("smhdw", rune(unit)) {
+				return t, fmt.Errorf("error while parsing date (%v): unsupported rounding unit", s)
+			}
+			t = roundTime(t, unit)
+		default:
+			return t, fmt.Errorf("error while parsing date (%v): unexpected '%c'", s, op)
+		}
+		expr = expr[i+1:]
+	}
+	return t, nil
+}
+
+// ParseAbsoluteTime parses a date that doesn't depend on the current time : RFC3339 (2019-07-31T00:00:00Z)
+// or epoch seconds (1564531200)
+func ParseAbsoluteTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if epoch, err := strconv.ParseInt(s, 10, 64); err == nil && !strings.HasPrefix(s, "-") && !strings.HasPrefix(s, "+") {
+		return time.Unix(epoch, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("unsupported date (%v): RFC3339 or epoch seconds expected", s)
+}
+
+// addTime adds n units (s, m, h, d, w) to a date, days and weeks are calendar days
+func addTime(t time.Time, n int, unit byte) (time.Time, error) {
+	switch unit {
+	case 's':
+		return t.Add(time.Duration(n) * time.Second), nil
+	case 'm':
+		return t.Add(time.Duration(n) * time.Minute), nil
+	case 'h':
+		return t.Add(time.Duration(n) * time.Hour), nil
+	case 'd':
+		return t.AddDate(0, 0, n), nil
+	case 'w':
+		return t.AddDate(0, 0, 7*n), nil
+	}
+	return t, fmt.Errorf("unsupported unit: %c", unit)
+}
+
+// roundTime rounds a date down to the start of its unit (s, m, h, d, w), weeks start on monday
+func roundTime(t time.Time, unit byte) time.Time {
+	y, mo, d := t.Date()
+	switch unit {
+	case 's':
+		return time.Date(y, mo, d, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+	case 'm':
+		return time.Date(y, mo, d, t.Hour(), t.Minute(), 0, 0, t.Location())
+	case 'h':
+		return time.Date(y, mo, d, t.Hour(), 0, 0, 0, t.Location())
+	case 'w':
+		return time.Date(y, mo, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, mo, d, 0, 0, 0, 0, t.Location())
+}
+
+// AlignTime rounds a date down to a multiple of the step (since the epoch)
+func AlignTime(t time.Time, step string) (time.Time, error) {
+	d, err := time.ParseDuration(step)
+	if err != nil {
+		return t, fmt.Errorf("error while parsing step (%v): %v", step, err)
+	}
+	if d <= 0 {
+		return t, fmt.Errorf("step must be positive (%v)", step)
+	}
+	ns := t.UnixNano()
+	rem := ns % int64(d)
+	if rem < 0 {
+		rem += int64(d)
+	}
+	return time.Unix(0, ns-rem).In(t.Location()), nil
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2019, 7, 31, 13, 42, 17, 0, time.UTC) // wednesday
+	var tcs = []struct {
+		tcID       string
+		in         string
+		expSuccess bool
+		exp        time.Time
+	}{
+		{"rfc3339", "2019-07-30T00:00:00Z", true, time.Date(2019, 7, 30, 0, 0, 0, 0, time.UTC)},
+		{"epoch", "1564531200", true, time.Date(2019, 7, 31, 0, 0, 0, 0, time.UTC)},
+		{"now", "now", true, now},
+		{"nowMinusHour", "now-1h", true, time.Date(2019, 7, 31, 12, 42, 17, 0, time.UTC)},
+		{"nowPlusMinutes", "now+30m", true, time.Date(2019, 7, 31, 14, 12, 17, 0, time.UTC)},
+		{"startOfDay", "now/d", true, time.Date(2019, 7, 31, 0, 0, 0, 0, time.UTC)},
+		{"startOfHour", "now/h", true, time.Date(2019, 7, 31, 13, 0, 0, 0, time.UTC)},
+		{"startOfWeek", "now/w", true, time.Date(2019, 7, 29, 0, 0, 0, 0, time.UTC)},
+		{"startOfPreviousDay", "now-1d/d", true, time.Date(2019, 7, 30, 0, 0, 0, 0, time.UTC)},
+		{"chained", "now/d-1w+2h", true, time.Date(2019, 7, 24, 2, 0, 0, 0, time.UTC)},
+		{"today", "today", true, time.Date(2019, 7, 31, 0, 0, 0, 0, time.UTC)},
+		{"yesterday", "yesterday", true, time.Date(2019, 7, 30, 0, 0, 0, 0, time.UTC)},
+		{"yesterdayOffset", "yesterday+12h", true, time.Date(2019, 7, 30, 12, 0, 0, 0, time.UTC)},
+		{"relative", "-24h", true, time.Date(2019, 7, 30, 13, 42, 17, 0, time.UTC)},
+		{"empty", "", false, time.Time{}},
+		{"garbage", "blabla", false, time.Time{}},
+		{"missingUnit", "now-1", false, time.Time{}},
+		{"missingValue", "now-h", false, time.Time{}},
+		{"unsupportedUnit", "now-1y", false, time.Time{}},
+		{"unsupportedRounding", "now/y", false, time.Time{}},
+		{"roundingWithValue", "now/1d", false, time.Time{}},
+		{"unexpectedOperator", "now*1d", false, time.Time{}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			o, err := ParseTime(tc.in, now)
+			assert.Equal(t, tc.expSuccess, err == nil)
+			if tc.expSuccess {
+				assert.True(t, tc.exp.Equal(o), "expected %v, got %v", tc.exp, o)
+			}
+		})
+	}
+}
+
+func TestParseAbsoluteTime(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		in         string
+		expSuccess bool
+		exp        time.Time
+	}{
+		{"rfc3339", "2019-07-30T00:00:00Z", true, time.Date(2019, 7, 30, 0, 0, 0, 0, time.UTC)},
+		{"epoch", "1564531200", true, time.Date(2019, 7, 31, 0, 0, 0, 0, time.UTC)},
+		{"now", "now", false, time.Time{}},
+		{"nowMinusDays", "now-30d", false, time.Time{}},
+		{"relative", "-24h", false, time.Time{}},
+		{"negativeEpoch", "-1564531200", false, time.Time{}},
+		{"empty", "", false, time.Time{}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			o, err := ParseAbsoluteTime(tc.in)
+			assert.Equal(t, tc.expSuccess, err == nil)
+			if tc.expSuccess {
+				assert.True(t, tc.exp.Equal(o), "expected %v, got %v", tc.exp, o)
+			}
+		})
+	}
+}
+
+func TestAlignTime(t *testing.T) {
+	in := time.Date(2019, 7, 31, 13, 42, 17, 0, time.UTC)
+	var tcs = []struct {
+		tcID       string
+		inStep     string
+		expSuccess bool
+		exp        time.Time
+	}{
+		{"minute", "1m", true, time.Date(2019, 7, 31, 13, 42, 0, 0, time.UTC)},
+		{"fiveMinutes", "5m", true, time.Date(2019, 7, 31, 13, 40, 0, 0, time.UTC)},
+		{"day", "24h", true, time.Date(2019, 7, 31, 0, 0, 0, 0, time.UTC)},
+		{"unparsable", "blabla", false, time.Time{}},
+		{"negative", "-1m", false, time.Time{}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			o, err := AlignTime(in, tc.inStep)
+			assert.Equal(t, tc.expSuccess, err == nil)
+			if tc.expSuccess {
+				assert.True(t, tc.exp.Equal(o), "expected %v, got %v", tc.exp, o)
+			}
+		})
+	}
+}